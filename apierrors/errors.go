@@ -0,0 +1,206 @@
+package apierrors
+
+//This package implements the errors of the communication between the worker and the server.
+//Each error has a Kind, which tells the caller how to react to it (e.g join the server again
+//on Auth errors, retry later on Transport or Server errors), and keeps the operation that
+//has failed, the HTTP status code and the response body, when there is one.
+//The errors can be matched with errors.Is against the Err* values of this package,
+//which only compare the Kind:
+//	if errors.Is(err, apierrors.ErrAuth) { ... }
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Kind uint8
+
+const (
+	Unknown Kind = iota
+	//The server doesn't recognize the worker's credentials (401 and 403)
+	Auth
+	//The resource doesn't exist in the server (404)
+	NotFound
+	//The request conflicts with the resource state in the server (409)
+	Conflict
+	//The request is invalid (any other 4xx)
+	BadRequest
+	//The worker has done too many requests (429)
+	RateLimited
+	//The server has failed to handle the request (5xx)
+	Server
+	//The request couldn't reach the server or the response couldn't be read
+	Transport
+	//The response body couldn't be decoded
+	Decode
+	//The server has nothing to answer (e.g an empty queue)
+	Empty
+	//The response signature is missing or invalid, so it can't be trusted
+	Signature
+)
+
+func (k Kind) String() string {
+	return [...]string{"unknown", "auth", "not found", "conflict", "bad request",
+		"rate limited", "server", "transport", "decode", "empty", "signature"}[k]
+}
+
+//The maximum amount of bytes of the response body shown by Error()
+const maxBodyLen = 256
+
+type Error struct {
+	Kind Kind
+	//The operation that has failed (e.g "join", "get task")
+	Op string
+	//The HTTP status code of the response, zero if there is no response
+	StatusCode int
+	//The response body, if there is one
+	Body []byte
+	//How long the server has asked the worker to wait before trying again (Retry-After)
+	RetryAfter time.Duration
+	//The underlying error, if any
+	Err error
+}
+
+var (
+	ErrAuth        = &Error{Kind: Auth}
+	ErrNotFound    = &Error{Kind: NotFound}
+	ErrConflict    = &Error{Kind: Conflict}
+	ErrBadRequest  = &Error{Kind: BadRequest}
+	ErrRateLimited = &Error{Kind: RateLimited}
+	ErrServer      = &Error{Kind: Server}
+	ErrTransport   = &Error{Kind: Transport}
+	ErrDecode      = &Error{Kind: Decode}
+	ErrEmpty       = &Error{Kind: Empty}
+	ErrSignature   = &Error{Kind: Signature}
+)
+
+func (e *Error) Error() string {
+	msg := e.Kind.String() + " error"
+	if e.Op != "" {
+		msg = e.Op + ": " + msg
+	}
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if len(e.Body) > 0 {
+		body := e.Body
+		if len(body) > maxBodyLen {
+			body = body[:maxBodyLen]
+		}
+		msg += fmt.Sprintf(" [body: %s]", body)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//It makes errors.Is match any *Error with the same Kind of target.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+//It creates an error of the given kind for the operation op.
+func New(kind Kind, op string, err error) *Error {
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+//It returns err as an *Error: err itself, if it is (or wraps) one already, or an
+//*Error of the Unknown kind for the operation op, wrapping err, otherwise.
+//A nil err stays nil.
+func Wrap(op string, err error) error {
+	var e *Error
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return New(Unknown, op, err)
+}
+
+//It checks the response of the operation op.
+//It returns:
+//1. nil if the status code is a successful one (2xx)
+//2. an *Error whose Kind matches the status code otherwise
+func FromResponse(op string, statusCode int, header http.Header, body []byte) error {
+	if statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+
+	return &Error{
+		Kind:       KindOf(statusCode),
+		Op:         op,
+		StatusCode: statusCode,
+		Body:       body,
+		RetryAfter: ParseRetryAfter(header),
+	}
+}
+
+//It returns the Kind of error that the status code stands for.
+func KindOf(statusCode int) Kind {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return Auth
+	case statusCode == http.StatusNotFound:
+		return NotFound
+	case statusCode == http.StatusConflict:
+		return Conflict
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimited
+	case statusCode >= 400 && statusCode < 500:
+		return BadRequest
+	case statusCode >= 500:
+		return Server
+	}
+	return Unknown
+}
+
+//It returns the Kind of err, or Unknown if it is not an *Error.
+func KindOfError(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
+
+//It returns how long the server has asked to wait before trying again,
+//or zero if err doesn't carry that information.
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+//It parses the Retry-After header, which is either an amount
+//of seconds or a HTTP date.
+//It returns zero if the header is missing, invalid or in the past.
+func ParseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if after := time.Until(date); after > 0 {
+			return after
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,103 @@
+package apierrors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFromResponse(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		expected   error
+	}{
+		{statusCode: 401, expected: ErrAuth},
+		{statusCode: 403, expected: ErrAuth},
+		{statusCode: 404, expected: ErrNotFound},
+		{statusCode: 409, expected: ErrConflict},
+		{statusCode: 400, expected: ErrBadRequest},
+		{statusCode: 429, expected: ErrRateLimited},
+		{statusCode: 500, expected: ErrServer},
+		{statusCode: 503, expected: ErrServer},
+	}
+
+	for _, c := range cases {
+		err := FromResponse("test", c.statusCode, http.Header{}, []byte("body"))
+
+		if !errors.Is(err, c.expected) {
+			t.Errorf("Status %d: expected %v, got %v", c.statusCode, c.expected, err)
+		}
+	}
+
+	if err := FromResponse("test", 201, http.Header{}, nil); err != nil {
+		t.Errorf("No error was expected for a successful response, got %v", err)
+	}
+}
+
+func TestErrorMatching(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("wrapped: %w", New(Transport, "get task", cause))
+
+	if !errors.Is(err, ErrTransport) {
+		t.Error("The wrapped error must match its kind")
+	}
+
+	if errors.Is(err, ErrAuth) {
+		t.Error("The wrapped error must not match other kinds")
+	}
+
+	if !errors.Is(err, cause) {
+		t.Error("The wrapped error must match its cause")
+	}
+
+	if KindOfError(err) != Transport {
+		t.Errorf("Expected the transport kind, got %v", KindOfError(err))
+	}
+}
+
+func TestWrap(t *testing.T) {
+	cause := errors.New("the key is missing")
+	transportErr := New(Transport, "get task", cause)
+
+	if err := Wrap("join", cause); KindOfError(err) != Unknown || !errors.Is(err, cause) || err.(*Error).Op != "join" {
+		t.Errorf("Expected an unknown error of the join operation wrapping the cause, got %v", err)
+	}
+
+	if err := Wrap("join", transportErr); err != transportErr {
+		t.Errorf("An *Error must not be wrapped again, got %v", err)
+	}
+
+	if err := Wrap("join", nil); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	header := http.Header{}
+
+	if after := ParseRetryAfter(header); after != 0 {
+		t.Errorf("Expected no delay without the header, got %s", after)
+	}
+
+	header.Set("Retry-After", "30")
+	if after := ParseRetryAfter(header); after != 30*time.Second {
+		t.Errorf("Expected 30s, got %s", after)
+	}
+
+	header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if after := ParseRetryAfter(header); after <= 59*time.Minute || after > time.Hour {
+		t.Errorf("Expected about one hour, got %s", after)
+	}
+
+	header.Set("Retry-After", "soon")
+	if after := ParseRetryAfter(header); after != 0 {
+		t.Errorf("Expected no delay for an invalid header, got %s", after)
+	}
+
+	err := FromResponse("test", 429, http.Header{"Retry-After": []string{"5"}}, nil)
+	if after := RetryAfter(err); after != 5*time.Second {
+		t.Errorf("Expected the error to carry the Retry-After, got %s", after)
+	}
+}
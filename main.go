@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -13,26 +19,85 @@ import (
 const (
 	ConfFilePathKey   = "CONF_FILE_PATH"
 	ServerEndpointKey = "SERVER_ENDPOINT"
+	//How long (in seconds) the running tasks may take to finish once
+	//the worker is asked to shut down, before they are cancelled
+	ShutdownGracePeriodKey     = "SHUTDOWN_GRACE_PERIOD"
+	DefaultShutdownGracePeriod = 30 * time.Second
+	//Maximum number of attempts and timeout (in seconds) of each request to the server
+	HttpMaxAttemptsKey = "HTTP_MAX_ATTEMPTS"
+	HttpTimeoutKey     = "HTTP_TIMEOUT"
 )
 
-func generateKeys(workerId string) {
-	log.Println("Starting to gen rsa key pair with workerid: " + workerId)
-	utils.GenAccessKeys(workerId)
+//It loads the worker's key pair, generating it only on the first start,
+//so that the server keeps trusting the worker across restarts.
+func loadKeys(workerId string) {
+	log.Println("Loading the key pair of worker: " + workerId)
+	if err := utils.LoadOrGenAccessKeys(workerId); err != nil {
+		log.Fatal("Error on loading the keys: " + err.Error())
+	}
 }
 
 func main() {
+	//the sandbox runner runs the worker binary again as the init of each sandbox
+	if len(os.Args) > 1 && os.Args[1] == worker.SandboxInitCommand {
+		worker.SandboxInit()
+	}
+
 	err := godotenv.Load()
 
 	if err != nil {
 		log.Println("No .env file found")
 	}
 
+	//the local execution doesn't talk to the server, so it needs neither the keys nor the TLS settings
+	if len(os.Args) > 1 && os.Args[1] == "run-local" {
+		os.Exit(runLocal(os.Args[2:]))
+	}
+
+	setupServerAccess()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-keys":
+			rotateKeys()
+		default:
+			log.Fatalf("Unknown command [%s]; the available ones are: rotate-keys, run-local", os.Args[1])
+		}
+		return
+	}
+
 	startWorker()
 }
 
-func startWorker() {
-	// This is the default work behavior implementation.
-	// Its core stands for executing one task at a time.
+//It sets up, from the environment, how the worker talks to the server: the key store and
+//algorithm of its signatures, the TLS and retries of its requests and the claims of its token.
+func setupServerAccess() {
+	utils.Keys = utils.NewKeyStoreFromEnv()
+	algorithm, err := utils.ParseAlgorithm(os.Getenv(utils.KeyAlgorithmKey))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	utils.KeyAlgorithm = algorithm
+
+	client, err := utils.NewHTTPClient(utils.TLSConfigFromEnv())
+	if err != nil {
+		log.Fatal("Error on configuring TLS: " + err.Error())
+	}
+	utils.Client = client
+
+	utils.Retry.MaxAttempts = intFromEnv(HttpMaxAttemptsKey, utils.Retry.MaxAttempts)
+	utils.Retry.Timeout = secondsFromEnv(HttpTimeoutKey, utils.Retry.Timeout)
+
+	if issuer := os.Getenv(worker.TokenIssuerKey); issuer != "" {
+		worker.TokenIssuer = issuer
+	}
+	if audience := os.Getenv(worker.TokenAudienceKey); audience != "" {
+		worker.TokenAudience = audience
+	}
+	worker.TokenLeeway = secondsFromEnv(worker.TokenLeewayKey, worker.TokenLeeway)
+}
+
+func readConfiguration() *worker.Worker {
 	log.Println("Starting reading configuration process")
 	file, err := os.Open(os.Getenv(ConfFilePathKey))
 
@@ -42,27 +107,149 @@ func startWorker() {
 
 	defer file.Close()
 
-	workerInstance := worker.ParseWorkerConfiguration(file)
+	return worker.ParseWorkerConfiguration(file)
+}
+
+//It replaces the worker's key pair, telling the server about the new public key.
+func rotateKeys() {
+	workerInstance := readConfiguration()
+	workerId := workerInstance.ID.String()
+
+	//the rotation request is signed with the current keys, and
+	//authorized by the token that the worker gets on joining the server
+	loadKeys(workerId)
+
+	if err := workerInstance.RotateKeys(os.Getenv(ServerEndpointKey)); err != nil {
+		log.Fatal("Error on rotating the keys: " + err.Error())
+	}
+}
+
+func startWorker() {
+	// This is the default work behavior implementation.
+	// Its core stands for executing as many tasks at a time as
+	// the worker's slots allow (see worker.Scheduler).
+	workerInstance := readConfiguration()
+
+	if err := worker.CheckRunner(workerInstance.Runner); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := workerInstance.CheckResources(); err != nil {
+		log.Fatal("Invalid worker configuration: " + err.Error())
+	}
 
 	serverEndpoint := os.Getenv(ServerEndpointKey)
 
-	//before join the server, the worker must generate the keys
-	generateKeys(workerInstance.ID.String())
-
-	workerInstance.Join(serverEndpoint)
-
-	for {
-		task, err := workerInstance.GetTask(serverEndpoint)
-		time.Sleep(3 * time.Second)
-		if err != nil {
-			//it will force the worker to Join again, if the error has occurred because of
-			//authentication issues. This is a work arround while the system doesn't have
-			//its own Error module that will allow it to identify the error type.
-			// workerInstance.Join(serverEndpoint)
-			workerInstance.Join(serverEndpoint)
-			continue
+	//before join the server, the worker must have its keys
+	loadKeys(workerInstance.ID.String())
+
+	if err := workerInstance.Join(serverEndpoint); err != nil {
+		log.Fatal("Error on joining the server: " + err.Error())
+	}
+
+	//on SIGTERM or SIGINT, the worker stops getting new tasks, drains the
+	//running ones and leaves the server before exiting, unless the signal comes again
+	ctx := signalContext()
+
+	scheduler := worker.NewScheduler(workerInstance, serverEndpoint)
+	scheduler.Start(ctx)
+	scheduler.Drain(secondsFromEnv(ShutdownGracePeriodKey, DefaultShutdownGracePeriod))
+	workerInstance.Close()
+
+	if err := workerInstance.Leave(serverEndpoint); err != nil {
+		log.Println(err)
+	}
+	log.Println("The worker has been shut down")
+}
+
+//It runs a task file on this node, without a server, printing its progress to the
+//terminal (see worker.RunLocal). The runner comes from the worker conf, if there is one,
+//unless the -runner flag is given. It returns the exit code of the execution.
+func runLocal(args []string) int {
+	flags := flag.NewFlagSet("run-local", flag.ExitOnError)
+	runner := flags.String("runner", "", "the runner of the task: docker (default), process or sandbox")
+	rootfs := flags.String("rootfs", "", "the rootfs tarball of the sandbox runner, instead of the task's image")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s run-local [flags] TASK_FILE (.json, .yaml or .yml)\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	workerInstance := &worker.Worker{}
+	if os.Getenv(ConfFilePathKey) != "" {
+		workerInstance = readConfiguration()
+		if err := workerInstance.CheckResources(); err != nil {
+			log.Fatal("Invalid worker configuration: " + err.Error())
+		}
+	}
+	if *runner != "" {
+		workerInstance.Runner = *runner
+	}
+	if *rootfs != "" {
+		workerInstance.Rootfs = *rootfs
+	}
+
+	if err := worker.CheckRunner(workerInstance.Runner); err != nil {
+		log.Fatal(err)
+	}
+
+	task, err := worker.ReadTaskFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//on SIGTERM or SIGINT, the task is cancelled
+	defer workerInstance.Close()
+	return workerInstance.RunLocal(signalContext(), task, os.Stdout)
+}
+
+//It returns a context that is done once the process receives SIGTERM or SIGINT.
+//A second signal makes the process exit at once, as the shells do on a signal
+//(128 plus the signal number), without waiting for the shutdown to finish.
+func signalContext() context.Context {
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received signal [%s]; shutting down (send it again to exit at once)", sig)
+		stop()
+
+		sig = <-signals
+		log.Printf("Received signal [%s] again; exiting without finishing the shutdown", sig)
+		code := 1
+		if number, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(number)
 		}
+		os.Exit(code)
+	}()
+	return ctx
+}
+
+//It reads a non-negative integer from the environment variable key.
+//If it is missing or invalid, the default value is returned.
+func intFromEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
 
-		workerInstance.ExecTask(task, serverEndpoint)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s [%s]; using the default one", key, value)
+		return defaultValue
 	}
+
+	return n
+}
+
+//It reads an amount of seconds from the environment variable key.
+//If it is missing or invalid, the default value is returned.
+func secondsFromEnv(key string, defaultValue time.Duration) time.Duration {
+	return time.Duration(intFromEnv(key, int(defaultValue/time.Second))) * time.Second
 }
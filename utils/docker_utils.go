@@ -3,18 +3,23 @@ package utils
 //This file implements some functions that are usually called in sequence
 //to achieve some common results, some of them are listed below:
 //Create a container and let it ready: CheckImage; Pull; CreateContainer; StartContainer.
-//Copy a file from the host to the container: Copy.
-//To write some array of content to a file inside the container: Write.
-//To run a valid command inside the container: Exec
+//Copy a file or directory from the host to the container: CopyToContainer.
+//To write some content to a file inside the container: WriteFile.
+//To run a command inside the container: DetectShell; ExecCommand or ExecStream.
+//To read a file inside the container: ReadFile.
 //To kill/remove the container: StopContainer; RemoveContainer.
 //Note that the sequence above is usually ran to use the container for the most common purposes.
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -22,12 +27,23 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 type ContainerConfig struct {
 	Name   string
 	Image  string
 	Mounts []mount.Mount
+	//CPU limit in units of 10^-9 CPUs (e.g 1.5 CPUs is 1500000000).
+	//Zero means no limit.
+	NanoCPUs int64
+	//Memory limit in bytes. Zero means no limit.
+	Memory int64
+	//Total memory limit (memory + swap) in bytes.
+	//Setting it equal to Memory disables swap usage.
+	MemorySwap int64
+	//Maximum number of processes inside the container. Zero means no limit.
+	PidsLimit int64
 }
 
 //Creates a new docker client
@@ -54,18 +70,24 @@ func NewDockerClient(host string) *client.Client {
 
 //Creates a container
 //Params:
+//ctx - the context that allows the creation to be interrupted
 //cli - the docker client whose host will get the new container
 //config - the container configuration. That's the way to set
-//the container name, image and possible mounts.
+//the container name, image, possible mounts and resource limits.
 //It returns:
 //1. an empty string and an error if it faces some problem on container creation
 //(e.g a already used container name)
 //2. the container id and nil otherwise.
-func CreateContainer(cli *client.Client, config ContainerConfig) (string, error) {
+func CreateContainer(ctx context.Context, cli *client.Client, config ContainerConfig) (string, error) {
 	log.Printf("Creating Container [%s]", config.Name)
-	ctx := context.Background()
 	hostConfig := container.HostConfig{
 		Mounts: config.Mounts,
+		Resources: container.Resources{
+			NanoCPUs:   config.NanoCPUs,
+			Memory:     config.Memory,
+			MemorySwap: config.MemorySwap,
+			PidsLimit:  config.PidsLimit,
+		},
 	}
 
 	dconfig := container.Config{
@@ -84,14 +106,15 @@ func CreateContainer(cli *client.Client, config ContainerConfig) (string, error)
 
 //Starts an existent container
 //Params:
+//ctx - the context that allows the start to be interrupted
 //cli - the docker client
 //id - the container id
 //It returns:
 //1. an error if the passed id doesn't exists
 //2. nil otherwise.
-func StartContainer(cli *client.Client, id string) error {
+func StartContainer(ctx context.Context, cli *client.Client, id string) error {
 	log.Printf("Starting Container [%s]", id)
-	return cli.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
+	return cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
 }
 
 //Stops a container
@@ -121,136 +144,394 @@ func RemoveContainer(cli *client.Client, id string) error {
 	return cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{})
 }
 
-//Iterates over the content and write each one to the destination file inside the container
+//Writes the content to the dest file inside the container, replacing it if it exists.
+//The content is sent as is, through the docker archive API, so it may hold any bytes.
 //Params:
+//ctx - the context that allows the writing to be interrupted
 //cli - the docker client
 //id - the container id
-//content - the array that stores the content.
-//Each position of the array will become a line in the dest file
-//dest - the destination file path, inside the container.
+//content - the file content
+//dest - the destination file path, inside the container. Its directory must exist.
+//mode - the permission bits of the file (e.g 0644)
 //It returns:
 //1. an error if the passed id doesn't exists or if the destination file is a invalid one
 //2. nil otherwise.
-func Write(cli *client.Client, id string, content []string, dest string) error {
-	for _, c := range content {
-		c = strings.ReplaceAll(c, "'", "'\"'\"'")
-		cmd := fmt.Sprintf(`echo -E '%s' >> %s`, c, dest)
-		log.Printf("Writing [%s] on [%s] from Container [%s]", c, dest, id)
-		err := Exec(cli, id, cmd)
-		if err != nil {
-			return err
-		}
+func WriteFile(ctx context.Context, cli *client.Client, id string, content []byte, dest string, mode os.FileMode) error {
+	log.Printf("Writing %d bytes on [%s] from Container [%s]", len(content), dest, id)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Base(dest),
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
 	}
-	return nil
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(ctx, id, path.Dir(dest), &archive, types.CopyToContainerOptions{})
 }
 
-//It copies the src file, which lives in the worker host,
-//to the dest file inside the container.
+//It copies the src file or directory, which lives in the worker host,
+//into the destDir directory inside the container, keeping the files modes.
 //Params:
+//ctx - the context that allows the copy to be interrupted
 //cli - the docker client
 //id - the container id
-//src - the source file path (in the worker host)
-//dest - the destination file, inside the container
+//src - the source file or directory path (in the worker host)
+//destDir - the destination directory, inside the container. It must exist.
 //It returns:
-//1. an error if the passed id doesn't exists or if the destination file is a invalid one
+//1. an error if the source can't be read, if the passed id doesn't exists
+//or if the destination directory is a invalid one
 //2. nil otherwise.
-func Copy(cli *client.Client, id, src, dest string) error {
-	log.Printf("Copy [%s] to [%s] from Container [%s]", src, dest, id)
-	dat, _ := ioutil.ReadFile(src)
-	content := string(dat)
-	content = strings.ReplaceAll(content, "'", "'\"'\"'")
-	cmd := fmt.Sprintf("echo -E '%s' >| %s", content, dest)
-	return Exec(cli, id, cmd)
+func CopyToContainer(ctx context.Context, cli *client.Client, id, src, destDir string) error {
+	log.Printf("Copy [%s] to [%s] from Container [%s]", src, destDir, id)
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	go func() {
+		writer.CloseWithError(tarPath(writer, src))
+	}()
+
+	return cli.CopyToContainer(ctx, id, destDir, reader, types.CopyToContainerOptions{})
 }
 
-//Executes a bash command inside the container
+//Reads a file inside the container through the docker archive API, so no
+//command is run on it and it works even if the container has been stopped.
 //Params:
+//ctx - the context that allows the reading to be interrupted
 //cli - the docker client
 //id - the container id
-//cmd - the bash command (e.g "echo 'arrebol'")
+//file - the file path inside the container
+//limit - the maximum amount of bytes to be read. Zero means no limit.
 //It returns:
-//1. an error if the command couldn't be executed inside the container
-//(e.g call a binary that doesn't exists), or if the id doesn't exists
-//2. nil otherwise.
-func Exec(cli *client.Client, id, cmd string) error {
-	log.Printf("Executing command [%s] on container [%s]", cmd, id)
-	config := types.ExecConfig{
-		Cmd: []string{"/bin/bash", "-c", cmd},
+//1. nil and an error if the id or the file doesn't exists
+//2. The last limit bytes of the file (or the whole file, if it is smaller) and nil otherwise.
+func ReadFile(ctx context.Context, cli *client.Client, id, file string, limit int) ([]byte, error) {
+	reader, _, err := cli.CopyFromContainer(ctx, id, file)
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("[%s] is not a regular file", file)
+	}
+	return readTail(tr, limit)
+}
+
+//It reads r up to its end, keeping only its last limit bytes (all of them, if limit is zero).
+func readTail(r io.Reader, limit int) ([]byte, error) {
+	content := make([]byte, 0)
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		content = append(content, chunk[:n]...)
+		if limit > 0 && len(content) > limit {
+			content = append(content[:0], content[len(content)-limit:]...)
+		}
+
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//It writes the src file or directory as a tar archive to w.
+//The entries are named relative to the parent directory of src,
+//so that src itself is the root of the archive.
+func tarPath(w io.Writer, src string) error {
+	tw := tar.NewWriter(w)
+	src = filepath.Clean(src)
+	base := filepath.Dir(src)
+
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err != nil {
+		return err
 	}
-	rid, _ := cli.ContainerExecCreate(context.Background(), id, config)
-	return cli.ContainerExecStart(context.Background(), rid.ID, types.ExecStartCheck{})
+	return tw.Close()
 }
 
-//Executes cat in a file inside the container and returns its output
+//It writes the content of r to the file, with the given mode regardless of the umask.
+func writeFile(file string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(file, mode)
+}
+
+//The result of a command executed inside a container
+type ExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+var (
+	//Maximum time spent checking whether a shell exists inside the container (see DetectShell)
+	ReadTimeout = 30 * time.Second
+	//The shells looked for in the containers, in order of preference
+	Shells = []string{"/bin/bash", "/bin/sh", "/busybox/sh"}
+	//The error returned when an image has none of the Shells (e.g a distroless one).
+	//The task's commands are shell commands, so such an image can't run a task at all.
+	ErrNoShell = errors.New("the image has no shell")
+	//Interval between the checks of whether an executed command is over
+	execInspectInterval = 50 * time.Millisecond
+)
+
+//Executes a command inside the container and waits for it to finish.
+//The command runs without a TTY, so its stdout and stderr are kept apart.
 //Params:
+//ctx - the context that allows the execution to be interrupted
 //cli - the docker client
 //id - the container id
-//path - the file path inside the container
+//cmd - the command and its arguments (e.g []string{"cat", "/arrebol/task-id.ts"})
+//timeout - the maximum duration of the execution. Zero means no limit besides ctx.
+//It returns:
+//1. an empty result and an error if the command couldn't be executed inside the container
+//(e.g the id doesn't exists), or if ctx is done or the timeout expires before it finishes
+//2. the exit code and the output of the command and nil otherwise, whatever the exit code is.
+func ExecCommand(ctx context.Context, cli *client.Client, id string, cmd []string, timeout time.Duration) (ExecResult, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := ExecStream(ctx, cli, id, cmd, timeout, &stdout, &stderr)
+
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return ExecResult{ExitCode: exitCode, Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, nil
+}
+
+//Executes a command inside the container, as ExecCommand does, but the output
+//is written to stdout and stderr while the command runs.
 //It returns:
-//1. nil and an error if the id doesn't exists,
-//or if the file path is invalid.
-//2. The file content as byte array and nil otherwise.
-func Read(cli *client.Client, id, path string) ([]byte, error) {
-	log.Printf("Getting content of file [%s]", path)
+//1. -1 and an error if the command couldn't be executed inside the container,
+//or if ctx is done or the timeout expires before it finishes
+//2. the exit code of the command and nil otherwise.
+func ExecStream(ctx context.Context, cli *client.Client, id string, cmd []string, timeout time.Duration,
+	stdout, stderr io.Writer) (int, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	config := types.ExecConfig{
-		Tty:          true,
 		AttachStderr: true,
 		AttachStdout: true,
-		Cmd:          []string{"/bin/bash", "-c", "cat " + path},
+		Cmd:          cmd,
 	}
-	rid, err := cli.ContainerExecCreate(context.Background(), id, config)
+	exec, err := cli.ContainerExecCreate(ctx, id, config)
+
 	if err != nil {
-		log.Println("error on creating container exec" + err.Error())
+		return -1, err
 	}
-	hijack, err := cli.ContainerExecAttach(context.Background(), rid.ID, config)
+
+	hijack, err := cli.ContainerExecAttach(ctx, exec.ID, config)
 
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
-	output, err := read(hijack.Conn)
 
-	if err != nil {
-		return nil, err
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, hijack.Reader)
+		copied <- err
+	}()
+
+	select {
+	case err := <-copied:
+		hijack.Close()
+		if err != nil {
+			return -1, err
+		}
+	case <-ctx.Done():
+		hijack.Close()
+		//the writers must not be used once it returns
+		<-copied
+		return -1, ctx.Err()
+	}
+
+	//the output is over, but the exit code may not be available yet
+	for {
+		inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+
+		if err != nil {
+			return -1, err
+		}
+
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+
+		select {
+		case <-time.After(execInspectInterval):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
 	}
-	return output, nil
 }
 
-//It reads the content that comes from the connection received
-//as parameter
+//Finds out which of the Shells is available inside the container
 //Params:
-//conn - the connection from which the content is read
+//ctx - the context that allows the detection to be interrupted
+//cli - the docker client
+//id - the container id
 //It returns:
-//1. nil and an error, if there is no content in the connection socket
-//2. a byte array with the content that came from the connection and nil otherwise
-func read(conn net.Conn) ([]byte, error) {
-	result := make([]byte, 0)
-	b := make([]byte, 10)
-	for {
-		n, err := conn.Read(b)
+//1. an empty string and an error wrapping ErrNoShell if the container has none
+//of the Shells (e.g a distroless image), or another error if the id doesn't exists
+//2. the path of the first available shell and nil otherwise.
+func DetectShell(ctx context.Context, cli *client.Client, id string) (string, error) {
+	shell, err := FindShell(func(shell string) (bool, error) {
+		result, err := ExecCommand(ctx, cli, id, []string{shell, "-c", "exit 0"}, ReadTimeout)
 
-		if err != nil {
-			log.Println(err)
-			return nil, err
+		if ctx.Err() != nil {
+			return false, ctx.Err()
 		}
+		return err == nil && result.ExitCode == 0, nil
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("container [%s]: %w", id, err)
+	}
+	log.Printf("Using the shell [%s] on container [%s]", shell, id)
+	return shell, nil
+}
 
-		result = append(result, b...)
-		if n < len(b) {
-			break
+//Finds out which of the Shells is available, trying them in order of preference
+//Params:
+//available - it tells whether a shell is available, or returns an error that stops the search
+//It returns:
+//1. an empty string and an error wrapping ErrNoShell if none of the Shells is available
+//2. an empty string and the error of available, if any
+//3. the path of the first available shell and nil otherwise.
+func FindShell(available func(shell string) (bool, error)) (string, error) {
+	for _, shell := range Shells {
+		ok, err := available(shell)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return shell, nil
 		}
-		b = make([]byte, 2*len(b))
 	}
-	return result, nil
+	return "", fmt.Errorf("%w; the supported ones are: %s", ErrNoShell, strings.Join(Shells, ", "))
+}
+
+//Creates a directory inside the container, as mkdir -p does, without running any command on it.
+//Params:
+//ctx - the context that allows the creation to be interrupted
+//cli - the docker client
+//id - the container id
+//dir - the absolute path of the directory, inside the container
+//mode - the permission bits of the directory (e.g 0755)
+//It returns:
+//1. an error if the passed id doesn't exists or if the directory couldn't be created
+//2. nil otherwise.
+func MakeDir(ctx context.Context, cli *client.Client, id, dir string, mode os.FileMode) error {
+	log.Printf("Creating the directory [%s] on Container [%s]", dir, id)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     strings.TrimPrefix(path.Clean(dir), "/") + "/",
+		Mode:     int64(mode.Perm()),
+		ModTime:  time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(ctx, id, "/", &archive, types.CopyToContainerOptions{})
 }
 
 //Downloads a docker image
 //Params:
+//ctx - the context that allows the download to be interrupted
 //cli - the docker client
 //image - the docker image (e.g library/ubuntu:16.04)
 //It returns:
 //1. nil and an error if the image couldn't be downloaded
-//2. A reader and nil otherwise.
-func Pull(cli *client.Client, image string) (io.ReadCloser, error) {
-	reader, err := cli.ImagePull(context.Background(), image, types.ImagePullOptions{})
+//2. A reader with the download progress and nil otherwise.
+//The download is only complete once the reader is fully consumed.
+func Pull(ctx context.Context, cli *client.Client, image string) (io.ReadCloser, error) {
+	reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
 	return reader, err
 }
 
@@ -258,16 +539,20 @@ func Pull(cli *client.Client, image string) (io.ReadCloser, error) {
 //In the image library/ubuntu:16.04, for example, it checks if
 //library/ubuntu really exists, and if 16.04 is a valid tag.
 //Params:
+//ctx - the context that allows the checking to be interrupted
 //cli - docker client
 //image - the docker image
 //It returns:
-//1. false and an error if the image is invalid
-//2. true and nil otherwise
-func CheckImage(cli *client.Client, image string) (exist bool, err error) {
+//1. false and nil if the image is not available in the docker host
+//2. false and an error if the image couldn't be checked
+//3. true and nil otherwise
+func CheckImage(ctx context.Context, cli *client.Client, image string) (exist bool, err error) {
 	exist = false
-	_, _, err = cli.ImageInspectWithRaw(context.Background(), image)
+	_, _, err = cli.ImageInspectWithRaw(ctx, image)
 	if err == nil {
 		exist = true
+	} else if client.IsErrImageNotFound(err) {
+		err = nil
 	}
 	return
 }
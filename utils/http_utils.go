@@ -2,145 +2,261 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ufcg-lsd/arrebol-pb-worker/apierrors"
 )
 
 type HTTPBody struct {
-	Worker    interface{}
-	Signature []byte
+	Worker interface{}
 }
 
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-const (
-	SIGNATURE_KEY_PATTERN = "Signature"
-)
-
 var (
-	Client       HTTPClient                                        = &http.Client{}
-	GetSignature func(payload interface{}, workerId string) []byte = getSignature
+	Client HTTPClient = &http.Client{}
 )
 
-type HttpResponse struct {
-	Body       []byte
-	Headers    http.Header
-	StatusCode int
+//It defines how the requests to the server are retried. A request is retried when:
+//1. it couldn't reach the server and it is idempotent (GET, PUT, DELETE or see PostIdempotent)
+//2. the server has answered 429 or 5xx
+//Between two attempts, the worker waits a random delay (full jitter) of up to
+//BaseDelay * 2^(attempt-1), or the server's Retry-After, if it is longer.
+//Either way, the delay is bounded by MaxDelay, and it is interrupted as soon as
+//the request's context is done.
+type RetryPolicy struct {
+	//Maximum number of attempts of each request, the first one included
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//Timeout of each attempt. Zero means no timeout.
+	Timeout time.Duration
 }
 
-func getSignature(payload interface{}, workerId string) []byte {
-	parsedPayload, err := json.Marshal(payload)
-
-	if err != nil {
-		log.Fatal("Error on marshalling the payload")
+var (
+	Retry = RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Timeout:     30 * time.Second,
 	}
+	//for test purpose
+	sleep = sleepContext
 
-	signature, _ := SignMessage(GetPrivateKey(workerId), parsedPayload)
-
-	return signature
-}
-
-func AddSignature(workerId string, payload interface{}, headers http.Header) (http.Header, []byte) {
-	signature := GetSignature(payload, workerId)
-	strSignature := fmt.Sprintf("%v", signature)
-	headers.Set(SIGNATURE_KEY_PATTERN, strSignature)
-	return headers, signature
-}
-
-func Post(workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
-	headers, signature := AddSignature(workerId, body, headers)
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
 
-	requestBody, err := json.Marshal(HTTPBody{Worker: body, Signature: signature})
+//It sends a single attempt of the request, within the policy's Timeout, and reads the whole response.
+func (p RetryPolicy) send(req *http.Request) (*HttpResponse, error) {
+	op := req.Method + " " + req.URL.String()
 
-	if err != nil {
-		log.Fatal("Unable to marshal body")
+	if p.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), p.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header = headers
-
 	resp, err := Client.Do(req)
 
 	if err != nil {
-		return nil, err
+		return nil, apierrors.New(apierrors.Transport, op, err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		return nil, err
+		return nil, &apierrors.Error{Kind: apierrors.Transport, Op: op, StatusCode: resp.StatusCode, Err: err}
 	}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode, Request: req}, nil
 }
 
-func Get(workerId string, endpoint string, header http.Header) (*HttpResponse, error) {
-	header, _ = AddSignature(workerId, endpoint, header)
+func (p RetryPolicy) shouldRetry(idempotent bool, resp *HttpResponse, err error) bool {
+	if err != nil {
+		return idempotent
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
 
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+//It returns a random delay between zero and the backoff of the given attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.BaseDelay
+	for i := 1; i < attempt && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
 
-	if err != nil {
-		return nil, err
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration(jitter.Int63n(int64(backoff) + 1))
+}
+
+type HttpResponse struct {
+	Body       []byte
+	Headers    http.Header
+	StatusCode int
+	//The request that has got the response, i.e the last attempt
+	Request *http.Request
+}
+
+//It sends the request built by newRequest, retrying it according to the Retry policy,
+//and reads the whole response. Each attempt uses a new request. The transport errors
+//are only retried if the request is idempotent.
+//It returns the last response and nil, whatever its status code is, or nil and
+//an *apierrors.Error of the Transport kind if the request couldn't be done.
+//When ctx is done while waiting for the next attempt, the last result is returned.
+func do(ctx context.Context, idempotent bool, newRequest func(ctx context.Context) (*http.Request, error)) (*HttpResponse, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := Retry.send(req)
+
+		if attempt >= Retry.MaxAttempts || !Retry.shouldRetry(idempotent, resp, err) {
+			return resp, err
+		}
+
+		delay := Retry.delay(attempt)
+		if resp != nil {
+			if retryAfter := apierrors.ParseRetryAfter(resp.Headers); retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+		//a long Retry-After must not hold the worker's goroutines
+		if Retry.MaxDelay > 0 && delay > Retry.MaxDelay {
+			delay = Retry.MaxDelay
+		}
+
+		reason := "status " + strconv.Itoa(resp.statusCode())
+		if err != nil {
+			reason = err.Error()
+		}
+		log.Printf("Attempt %d of %d of %s %s has failed (%s); retrying in %s",
+			attempt, Retry.MaxAttempts, req.Method, req.URL, reason, delay)
+		if !sleep(ctx, delay) {
+			return resp, err
+		}
 	}
+}
 
-	req.Header = header
+//It sleeps for the given duration.
+//It returns false if ctx is done before that.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	resp, err := Client.Do(req)
-	if err != nil {
-		return nil, err
+func (r *HttpResponse) statusCode() int {
+	if r == nil {
+		return 0
 	}
+	return r.StatusCode
+}
 
-	defer resp.Body.Close()
+//It returns a function that builds the request at each call, signed
+//by the worker (see SignRequest), so that each attempt has its own signature.
+func signedRequest(workerId, method, endpoint string, headers http.Header, body []byte) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
 
-	if err != nil {
-		log.Println("The following error occurred on parsing response body: " + err.Error())
-		return &HttpResponse{nil, resp.Header, resp.StatusCode}, err
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header = headers.Clone()
+
+		if err := SignRequest(req, workerId, body); err != nil {
+			return nil, errors.New("Unable to sign the request: " + err.Error())
+		}
+		return req, nil
 	}
+}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+func Post(ctx context.Context, workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
+	return post(ctx, false, workerId, body, headers, endpoint)
 }
 
-func Put(workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
-	headers, _ = AddSignature(workerId, body, headers)
+//It sends the request as Post does, but it is also retried when the server couldn't be
+//reached. It must only be used when the server handles a repeated request as a single
+//one (e.g joining the server again just assigns the worker a new token).
+func PostIdempotent(ctx context.Context, workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
+	return post(ctx, true, workerId, body, headers, endpoint)
+}
 
-	requestBody, err := json.Marshal(body)
+//It sends the request as Post does, but in a single attempt, even on 429 and 5xx.
+//It must be used when the outcome of each attempt must be known (e.g the key rotation,
+//whose next attempts would be signed by a key that the server may not trust anymore).
+func PostOnce(ctx context.Context, workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
+	requestBody, err := json.Marshal(HTTPBody{Worker: body})
 
 	if err != nil {
-		return nil, errors.New("Unable to marshal body")
+		return nil, errors.New("Unable to marshal body: " + err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewBuffer(requestBody))
+	req, err := signedRequest(workerId, http.MethodPost, endpoint, headers, requestBody)(ctx)
 
 	if err != nil {
 		return nil, err
 	}
+	return Retry.send(req)
+}
 
-	req.Header = headers
-	resp, err := Client.Do(req)
+func post(ctx context.Context, idempotent bool, workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
+	requestBody, err := json.Marshal(HTTPBody{Worker: body})
 
 	if err != nil {
-		return nil, errors.New("Unable to reach the server on endpoint: " + endpoint)
+		return nil, errors.New("Unable to marshal body: " + err.Error())
 	}
-	defer resp.Body.Close()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+	return do(ctx, idempotent, signedRequest(workerId, http.MethodPost, endpoint, headers, requestBody))
+}
+
+func Get(ctx context.Context, workerId string, endpoint string, header http.Header) (*HttpResponse, error) {
+	return do(ctx, true, signedRequest(workerId, http.MethodGet, endpoint, header, nil))
+}
+
+func Put(ctx context.Context, workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
+	requestBody, err := json.Marshal(body)
 
 	if err != nil {
-		return nil, errors.New("Error on parsing the body to byte")
+		return nil, errors.New("Unable to marshal body: " + err.Error())
 	}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+	return do(ctx, true, signedRequest(workerId, http.MethodPut, endpoint, headers, requestBody))
+}
+
+func Delete(ctx context.Context, workerId string, endpoint string, header http.Header) (*HttpResponse, error) {
+	return do(ctx, true, signedRequest(workerId, http.MethodDelete, endpoint, header, nil))
 }
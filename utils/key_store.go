@@ -0,0 +1,422 @@
+package utils
+
+//This file implements where the keys used by the worker are kept. Every key
+//operation (see keys_utils.go) goes through the KeyStore held by the Keys variable,
+//which can be replaced to keep the keys somewhere else. There are three backends:
+//FileKeyStore - the keys are PEM files in a directory (the default one)
+//EncryptedFileKeyStore - like FileKeyStore, but the private keys are encrypted with a passphrase
+//(AES-256-GCM, with a key derived from the passphrase by scrypt)
+//MemoryKeyStore - the keys only live in memory (e.g for tests)
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	//Passphrase of the private keys. If it is set, the private keys are kept encrypted.
+	KeysPassphraseKey = "KEYS_PASSPHRASE"
+	//The PEM type of the private keys encrypted by EncryptedFileKeyStore
+	encryptedKeyBlockType = "ARREBOL ENCRYPTED PRIVATE KEY"
+	//The key derivation function of the encrypted private keys, along with its parameters
+	encryptedKeyKDF = "scrypt;N=32768;r=8;p=1"
+	scryptN         = 32768
+	scryptR         = 8
+	scryptP         = 1
+)
+
+//The error returned when there is no key with the given name in the store
+var ErrKeyNotFound = errors.New("key not found")
+
+type KeyStore interface {
+	//It returns the private key named name, or an error wrapping
+	//ErrKeyNotFound if there is none.
+	PrivateKey(name string) (crypto.Signer, error)
+	//It returns the public key named name, or an error wrapping
+	//ErrKeyNotFound if there is none.
+	PublicKey(name string) (crypto.PublicKey, error)
+	//It saves the key pair of privateKey under the given name,
+	//replacing the existing one, if any.
+	Save(name string, privateKey crypto.Signer) error
+	//It removes the key pair named name. Removing a missing pair is not an error.
+	Remove(name string) error
+}
+
+//The store used by the worker
+var Keys KeyStore = &FileKeyStore{}
+
+//It creates the store described by the environment: an EncryptedFileKeyStore if
+//KEYS_PASSPHRASE is set, or a FileKeyStore otherwise, both in KEYS_PATH.
+func NewKeyStoreFromEnv() KeyStore {
+	store := FileKeyStore{Dir: os.Getenv(KeysPathKey)}
+	if passphrase := os.Getenv(KeysPassphraseKey); passphrase != "" {
+		return &EncryptedFileKeyStore{FileKeyStore: store, Passphrase: []byte(passphrase)}
+	}
+	return &store
+}
+
+//It keeps each key pair as two PEM files, <name>.priv and <name>.pub, in Dir.
+//If Dir is empty, the KEYS_PATH directory is used.
+type FileKeyStore struct {
+	Dir string
+}
+
+func (s *FileKeyStore) path(name, ext string) string {
+	dir := s.Dir
+	if dir == "" {
+		dir = os.Getenv(KeysPathKey)
+	}
+	return dir + "/" + name + ext
+}
+
+func (s *FileKeyStore) PrivateKey(name string) (crypto.Signer, error) {
+	block, err := s.read(name, ".priv")
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(block.Type, block.Bytes)
+}
+
+func (s *FileKeyStore) PublicKey(name string) (crypto.PublicKey, error) {
+	block, err := s.read(name, ".pub")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := parsePublicKey(block.Type, block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key [%s]: %w", name, err)
+	}
+	return publicKey, nil
+}
+
+func (s *FileKeyStore) Save(name string, privateKey crypto.Signer) error {
+	privatePem, err := EncodePrivKeyToPem(privateKey)
+	if err != nil {
+		return err
+	}
+
+	publicPem, err := EncodePublicKeyToPem(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	return s.save(name, privatePem, publicPem)
+}
+
+func (s *FileKeyStore) Remove(name string) error {
+	for _, ext := range []string{".pub", ".priv"} {
+		if err := os.Remove(s.path(name, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//It writes both keys to temporary files first, so that a failure
+//doesn't leave a half written pair behind. The private key is moved
+//into place first: if the public one can't follow it, the previous
+//public key is removed, since it can be recovered from the private
+//one (see LoadOrGenAccessKeys), while a mismatched pair can't.
+func (s *FileKeyStore) save(name string, privatePem, publicPem []byte) error {
+	privatePath, publicPath := s.path(name, ".priv"), s.path(name, ".pub")
+
+	if err := saveKey(privatePem, privatePath+".tmp"); err != nil {
+		return err
+	}
+	if err := saveKey(publicPem, publicPath+".tmp"); err != nil {
+		os.Remove(privatePath + ".tmp")
+		return err
+	}
+	if err := os.Rename(privatePath+".tmp", privatePath); err != nil {
+		os.Remove(privatePath + ".tmp")
+		os.Remove(publicPath + ".tmp")
+		return err
+	}
+	if err := os.Rename(publicPath+".tmp", publicPath); err != nil {
+		os.Remove(publicPath + ".tmp")
+		os.Remove(publicPath)
+		return err
+	}
+	return nil
+}
+
+func (s *FileKeyStore) read(name, ext string) (*pem.Block, error) {
+	path := s.path(name, ext)
+	content, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("there is no PEM data in " + path)
+	}
+	return block, nil
+}
+
+//It works like FileKeyStore, but the private keys are encrypted with Passphrase.
+//Each private key is sealed by AES-256-GCM, with a key derived from Passphrase
+//and a random salt by scrypt. Private keys saved without encryption are refused.
+type EncryptedFileKeyStore struct {
+	FileKeyStore
+	Passphrase []byte
+	//The keys derived from Passphrase, by salt, since deriving one is slow on purpose
+	mutex       sync.Mutex
+	derivedKeys map[string][]byte
+}
+
+func (s *EncryptedFileKeyStore) PrivateKey(name string) (crypto.Signer, error) {
+	block, err := s.read(name, ".priv")
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type != encryptedKeyBlockType {
+		return nil, fmt.Errorf("the private key [%s] is not encrypted, although %s is set", name, KeysPassphraseKey)
+	}
+
+	blockType, der, err := s.decrypt(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the private key [%s]: %w", name, err)
+	}
+	return parsePrivateKey(blockType, der)
+}
+
+func (s *EncryptedFileKeyStore) Save(name string, privateKey crypto.Signer) error {
+	blockType, der, err := marshalPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	block, err := s.encrypt(blockType, der)
+	if err != nil {
+		return err
+	}
+
+	publicPem, err := EncodePublicKeyToPem(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	return s.save(name, pem.EncodeToMemory(block), publicPem)
+}
+
+//It seals the DER of a private key whose PEM type is blockType. The salt, the nonce
+//and blockType itself, which is authenticated as well, go to the block's headers.
+func (s *EncryptedFileKeyStore) encrypt(blockType string, der []byte) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: encryptedKeyBlockType,
+		Headers: map[string]string{
+			"Key-Type": blockType,
+			"KDF":      encryptedKeyKDF,
+			"Salt":     base64.StdEncoding.EncodeToString(salt),
+			"Nonce":    base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, []byte(blockType)),
+	}, nil
+}
+
+//It opens a block sealed by encrypt.
+//It returns the PEM type and the DER of the private key.
+func (s *EncryptedFileKeyStore) decrypt(block *pem.Block) (string, []byte, error) {
+	if kdf := block.Headers["KDF"]; kdf != encryptedKeyKDF {
+		return "", nil, fmt.Errorf("unsupported key derivation function [%s]", kdf)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return "", nil, errors.New("invalid nonce")
+	}
+
+	blockType := block.Headers["Key-Type"]
+	der, err := aead.Open(nil, nonce, block.Bytes, []byte(blockType))
+	if err != nil {
+		return "", nil, errors.New("wrong passphrase or corrupted key")
+	}
+	return blockType, der, nil
+}
+
+//It returns the AES-256-GCM cipher whose key is derived from Passphrase and salt.
+func (s *EncryptedFileKeyStore) aead(salt []byte) (cipher.AEAD, error) {
+	s.mutex.Lock()
+	key, ok := s.derivedKeys[string(salt)]
+	s.mutex.Unlock()
+
+	if !ok {
+		var err error
+		if key, err = scrypt.Key(s.Passphrase, salt, scryptN, scryptR, scryptP, 32); err != nil {
+			return nil, err
+		}
+
+		s.mutex.Lock()
+		if s.derivedKeys == nil {
+			s.derivedKeys = make(map[string][]byte)
+		}
+		s.derivedKeys[string(salt)] = key
+		s.mutex.Unlock()
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//It keeps the keys in memory, so they are lost once the worker stops.
+type MemoryKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]crypto.Signer
+	//Public keys whose private keys are not known (e.g the server's one)
+	publicKeys map[string]crypto.PublicKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]crypto.Signer), publicKeys: make(map[string]crypto.PublicKey)}
+}
+
+func (s *MemoryKeyStore) PrivateKey(name string) (crypto.Signer, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	privateKey, ok := s.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, name)
+	}
+	return privateKey, nil
+}
+
+func (s *MemoryKeyStore) PublicKey(name string) (crypto.PublicKey, error) {
+	s.mutex.RLock()
+	publicKey, ok := s.publicKeys[name]
+	s.mutex.RUnlock()
+	if ok {
+		return publicKey, nil
+	}
+
+	privateKey, err := s.PrivateKey(name)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.Public(), nil
+}
+
+func (s *MemoryKeyStore) Save(name string, privateKey crypto.Signer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[name] = privateKey
+	delete(s.publicKeys, name)
+	return nil
+}
+
+func (s *MemoryKeyStore) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.keys, name)
+	delete(s.publicKeys, name)
+	return nil
+}
+
+//It adds a public key without its private key.
+func (s *MemoryKeyStore) SavePublic(name string, publicKey crypto.PublicKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.publicKeys[name] = publicKey
+}
+
+//The private keys are kept as PKCS #1 (RSA), so that the keys generated by older
+//versions of the worker can still be read, or PKCS #8 (ECDSA and Ed25519).
+//The public keys are kept as PKCS #1 (RSA) or PKIX.
+func marshalPrivateKey(privateKey crypto.Signer) (string, []byte, error) {
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok {
+		return "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	return "PRIVATE KEY", der, err
+}
+
+func marshalPublicKey(publicKey crypto.PublicKey) (string, []byte, error) {
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(rsaKey), nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	return "PUBLIC KEY", der, err
+}
+
+func parsePrivateKey(blockType string, der []byte) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		if err := rsaKey.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func parsePublicKey(blockType string, der []byte) (crypto.PublicKey, error) {
+	if blockType == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(der)
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
@@ -1,121 +1,242 @@
 package utils
 
 //This module handles with all operations related to keys: generation, retrieval
-//and messages signature. The last two ones are really needed by the system,
+//and encoding (the messages are signed by signatures.go). The last two ones are really needed by the system,
 //once they are part of its features. The first one could be addressed in deployment
 //time, when the user could use his own keys. The problem with this approach, is that
 //it is needed a specific format of keys, whose generation process is not user friendly.
 //So, generating them here, makes the deployment easier.
+//The keys are kept by the Keys store (see key_store.go).
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
 )
 
 const (
 	KeysPathKey = "KEYS_PATH"
+	//The algorithm of the keys generated by the worker (see the Algorithm constants)
+	KeyAlgorithmKey = "KEY_ALGORITHM"
+	//Suffix of the key pair that is being rotated and hasn't been accepted by the server yet
+	pendingKeySuffix = ".new"
 )
 
-func GenAccessKeys(id string) {
-	keyspath := os.Getenv(KeysPathKey)
-	privateKeyPath := keyspath + "/" + id + ".priv"
-	publicKeyPath := keyspath + "/" + id + ".pub"
-	bitSize := 4096
+//The signature algorithm of a key, as it is named to the server both in the
+//Public-Key header and in the alg of the signatures (see signatures.go)
+type Algorithm string
 
-	privateKey, err := GeneratePrivateKey(bitSize)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+//The names are the ones registered by RFC 9421, which defines how each algorithm signs
+const (
+	//RSA-PSS with SHA-512
+	RSAPSS Algorithm = "rsa-pss-sha512"
+	//ECDSA on the P-256 curve with SHA-256, whose signature is r and s concatenated
+	ECDSAP256 Algorithm = "ecdsa-p256-sha256"
+	Ed25519   Algorithm = "ed25519"
+)
 
-	privateKeyBytes, publicKeyBytes := encodeKeysToPem(privateKey, &privateKey.PublicKey)
+var (
+	//Size, in bits, of the generated RSA keys
+	KeyBitSize = 4096
+	//The algorithm of the generated keys. The existing keys
+	//keep their algorithm until they are rotated.
+	KeyAlgorithm = RSAPSS
+)
 
-	err = saveKey(privateKeyBytes, privateKeyPath)
-	if err != nil {
-		log.Fatal(err.Error())
+//It parses the name of an algorithm. An empty name stands for RSAPSS.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch alg := Algorithm(name); alg {
+	case "":
+		return RSAPSS, nil
+	case RSAPSS, ECDSAP256, Ed25519:
+		return alg, nil
 	}
+	return "", fmt.Errorf("unknown key algorithm [%s]; the available ones are: %s, %s, %s",
+		name, RSAPSS, ECDSAP256, Ed25519)
+}
 
-	err = saveKey(publicKeyBytes, publicKeyPath)
-	if err != nil {
-		log.Fatal(err.Error())
+//It returns the algorithm of the key.
+func AlgorithmOf(publicKey crypto.PublicKey) (Algorithm, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return RSAPSS, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return ECDSAP256, nil
+		}
+	case ed25519.PublicKey:
+		return Ed25519, nil
 	}
+	return "", fmt.Errorf("unsupported key type %T", publicKey)
+}
+
+//It generates a new key pair for the worker id, replacing the existing one.
+func GenAccessKeys(id string) error {
+	_, err := genKeyPair(id)
+	return err
 }
 
-func GetPrivateKey(id string) *rsa.PrivateKey {
-	keyName := "/" + id + ".priv"
-	decodedKey := decodeKey(keyName)
+//It loads the worker's key pair, generating a new one only if there is none yet.
+//If the public key is missing, it is recovered from the private one.
+//It returns:
+//1. an error if the existing keys are invalid or don't match each other,
+//which must be fixed by hand, so that the server-side trust isn't lost
+//2. nil otherwise
+func LoadOrGenAccessKeys(id string) error {
+	privateKey, err := Keys.PrivateKey(id)
+
+	if errors.Is(err, ErrKeyNotFound) {
+		log.Println("There is no key pair yet; generating a new one")
+		_, err = genKeyPair(id)
+		return err
+	}
 
-	rsaKey, err := x509.ParsePKCS1PrivateKey(decodedKey.Bytes)
 	if err != nil {
-		log.Fatal("Error on parsing private key " + err.Error())
+		return err
 	}
 
-	return rsaKey
-}
+	publicKey, err := Keys.PublicKey(id)
 
-func decodeKey(keyName string) *pem.Block {
-	keyspath := os.Getenv(KeysPathKey)
-	keyContent, err := ioutil.ReadFile(keyspath + keyName)
+	if errors.Is(err, ErrKeyNotFound) {
+		log.Println("The public key is missing; recovering it from the private one")
+		return Keys.Save(id, privateKey)
+	}
 
 	if err != nil {
-		log.Fatal("The private key is not where it should be")
+		return err
 	}
 
-	decodedKey, rest := pem.Decode(keyContent)
-
-	if len(rest) > 0 {
-		log.Fatal("Error on decoding private key; the rest is not empty.")
+	if !samePublicKey(publicKey, privateKey.Public()) {
+		return errors.New("the public key doesn't match the private key of worker " + id)
 	}
 
-	return decodedKey
-}
+	alg, err := AlgorithmOf(publicKey)
+	if err != nil {
+		return err
+	}
 
-func SignMessage(privateKey *rsa.PrivateKey, message []byte) ([]byte, []byte) {
-	messageHash := sha256.New()
-	writtenBytesCounter, err := messageHash.Write(message)
+	if alg != KeyAlgorithm {
+		log.Printf("The existing key pair is %s, instead of %s; rotate it to change the algorithm", alg, KeyAlgorithm)
+	}
 
-	if err != nil {
-		panic(err)
+	log.Printf("Reusing the existing %s key pair", alg)
+	if HasPendingAccessKeys(id) {
+		log.Println("An unfinished rotation has left a new key pair, which is settled on joining the server")
 	}
+	return nil
+}
 
-	if writtenBytesCounter != len(message) {
-		log.Fatal("The message has not been entirely written in the message hash.")
+//It returns the key pair that will replace the current one, which is kept apart until
+//CommitPendingAccessKeys is called (e.g once the server has accepted it). The pair
+//left by an unfinished rotation is reused, since the server may have accepted it;
+//otherwise, a new one is generated.
+//It returns the new public key, as PEM, or an error if the keys couldn't be saved.
+func PendingAccessKeys(id string) ([]byte, error) {
+	privateKey, err := Keys.PrivateKey(id + pendingKeySuffix)
+	if errors.Is(err, ErrKeyNotFound) {
+		privateKey, err = genKeyPair(id + pendingKeySuffix)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return EncodePublicKeyToPem(privateKey.Public())
+}
 
-	msgHashSum := messageHash.Sum(nil)
+//It checks if an unfinished rotation has left a pending key pair (see PendingAccessKeys).
+func HasPendingAccessKeys(id string) bool {
+	_, err := Keys.PrivateKey(id + pendingKeySuffix)
+	return err == nil
+}
 
-	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, msgHashSum, nil)
+//It makes the pending key pair the current one, and the current one the pending one,
+//so that the pair that the server trusts can be found without losing any of them.
+func SwapPendingAccessKeys(id string) error {
+	current, err := Keys.PrivateKey(id)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	pending, err := Keys.PrivateKey(id + pendingKeySuffix)
+	if err != nil {
+		return err
 	}
 
-	return signature, msgHashSum
+	if err := Keys.Save(id+pendingKeySuffix, current); err != nil {
+		return err
+	}
+	if err := Keys.Save(id, pending); err != nil {
+		//the pending pair only exists in memory now
+		if restoreErr := Keys.Save(id+pendingKeySuffix, pending); restoreErr != nil {
+			log.Println("Error on restoring the pending key pair: " + restoreErr.Error())
+		}
+		return err
+	}
+	return nil
 }
 
-func VerifySignature(key *rsa.PublicKey, hash []byte, signature []byte) bool {
-	err := rsa.VerifyPSS(key, crypto.SHA256, hash, signature, nil)
+//It replaces the current key pair by the one generated by GenPendingAccessKeys.
+func CommitPendingAccessKeys(id string) error {
+	privateKey, err := Keys.PrivateKey(id + pendingKeySuffix)
 	if err != nil {
-		return false
+		return err
 	}
-	return true
+
+	if err := Keys.Save(id, privateKey); err != nil {
+		return err
+	}
+
+	log.Println("The key pair has been rotated")
+	return Keys.Remove(id + pendingKeySuffix)
 }
 
-func GetPublicKey(id string) *rsa.PublicKey {
-	keyName := "/" + id + ".pub"
-	decodedKey := decodeKey(keyName)
+//It removes the key pair generated by GenPendingAccessKeys, keeping the current one.
+func DiscardPendingAccessKeys(id string) error {
+	return Keys.Remove(id + pendingKeySuffix)
+}
 
-	rsaKey, err := x509.ParsePKCS1PublicKey(decodedKey.Bytes)
+//It generates a new key pair of KeyAlgorithm and saves it under the given name.
+func genKeyPair(name string) (crypto.Signer, error) {
+	privateKey, err := GenerateKey(KeyAlgorithm)
 	if err != nil {
-		log.Fatal("Error on parsing public key " + err.Error())
+		return nil, err
+	}
+
+	if err := Keys.Save(name, privateKey); err != nil {
+		return nil, err
 	}
 
-	return rsaKey
+	return privateKey, nil
+}
+
+func GetPrivateKey(id string) (crypto.Signer, error) {
+	return Keys.PrivateKey(id)
+}
+
+func GetPublicKey(id string) (crypto.PublicKey, error) {
+	return Keys.PublicKey(id)
+}
+
+//It generates a private key of the given algorithm.
+func GenerateKey(alg Algorithm) (crypto.Signer, error) {
+	switch alg {
+	case RSAPSS:
+		return GeneratePrivateKey(KeyBitSize)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	}
+	return nil, fmt.Errorf("unknown key algorithm [%s]", alg)
 }
 
 // GeneratePrivateKey creates a RSA Private Key of specified byte size
@@ -136,36 +257,44 @@ func GeneratePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 	return privateKey, nil
 }
 
-func encodeKeysToPem(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) ([]byte, []byte) {
-	return EncodePrivKeyToPem(privateKey), EncodePublicKeyToPem(publicKey)
-}
-
-func EncodePrivKeyToPem(privKey *rsa.PrivateKey) []byte {
-	privDER := x509.MarshalPKCS1PrivateKey(privKey)
+func EncodePrivKeyToPem(privKey crypto.Signer) ([]byte, error) {
+	blockType, privDER, err := marshalPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
 
 	privBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
+		Type:    blockType,
 		Headers: nil,
 		Bytes:   privDER,
 	}
 
 	privPEM := pem.EncodeToMemory(&privBlock)
 
-	return privPEM
+	return privPEM, nil
 }
 
-func EncodePublicKeyToPem(publicKey *rsa.PublicKey) []byte {
-	publicDER := x509.MarshalPKCS1PublicKey(publicKey)
+func EncodePublicKeyToPem(publicKey crypto.PublicKey) ([]byte, error) {
+	blockType, publicDER, err := marshalPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
 
 	publicBlock := pem.Block{
-		Type:    "RSA PUBLIC KEY",
+		Type:    blockType,
 		Headers: nil,
 		Bytes:   publicDER,
 	}
 
 	publicPEM := pem.EncodeToMemory(&publicBlock)
 
-	return publicPEM
+	return publicPEM, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	aDER, aErr := x509.MarshalPKIXPublicKey(a)
+	bDER, bErr := x509.MarshalPKIXPublicKey(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aDER, bDER)
 }
 
 func saveKey(keyBytes []byte, filePath string) error {
@@ -179,14 +308,44 @@ func saveKey(keyBytes []byte, filePath string) error {
 }
 
 func GetBase64PubKey(workerId string) (string, error) {
-	keyPath := os.Getenv(KeysPathKey) + "/" + workerId + ".pub"
-	publicKey,err := ioutil.ReadFile(keyPath)
+	publicKey, err := Keys.PublicKey(workerId)
 
 	if err != nil {
 		return "", err
 	}
 
-	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	publicPem, err := EncodePublicKeyToPem(publicKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	encodedKey := base64.StdEncoding.EncodeToString(publicPem)
 
 	return encodedKey, nil
 }
+
+//It returns the value of the Public-Key header: the key algorithm and
+//the base64 encoded PEM of the public key, separated by a space
+//(e.g "ed25519 LS0tLS1CRUdJTi...").
+func GetPublicKeyHeader(workerId string) (string, error) {
+	publicKey, err := Keys.PublicKey(workerId)
+
+	if err != nil {
+		return "", err
+	}
+
+	alg, err := AlgorithmOf(publicKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	encodedKey, err := GetBase64PubKey(workerId)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(alg) + " " + encodedKey, nil
+}
@@ -0,0 +1,334 @@
+package utils
+
+//This file implements the download of images straight from a registry
+//(Docker Registry HTTP API v2), for the nodes that have no docker daemon.
+//Only public images are supported: the registry may ask for a token, which
+//is anonymously requested to its authorization service.
+//The layers are kept in a cache directory, named after their digests,
+//so an image is only downloaded once. To unpack them, see UnpackLayer.
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	//The registry of the images that don't name one (e.g ubuntu:20.04)
+	DefaultRegistry = "registry-1.docker.io"
+
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+//The client of the registries, which is not the one that talks to the server (see Client)
+var RegistryClient HTTPClient = &http.Client{}
+
+//The parts of an image name (e.g registry.example.com/team/app:1.0)
+type ImageReference struct {
+	Registry   string
+	Repository string
+	//The tag or the digest of the image
+	Reference string
+}
+
+//It parses an image name as docker does: the registry defaults to DefaultRegistry,
+//the official images of Docker Hub live under library/ and the tag defaults to latest.
+func ParseImageReference(image string) (ImageReference, error) {
+	ref := ImageReference{Registry: DefaultRegistry, Reference: "latest"}
+	name := image
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Reference = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Reference = name[:i], name[i+1:]
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Registry, name = first, name[i+1:]
+		}
+	}
+
+	if name == "" || ref.Reference == "" || strings.ToLower(name) != name {
+		return ImageReference{}, fmt.Errorf("invalid image name [%s]", image)
+	}
+
+	if ref.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	ref.Repository = name
+	return ref, nil
+}
+
+//It downloads the layers of the image to the cache directory, unless they are there already.
+//When the image is available for several platforms, the linux one of the worker's
+//architecture is chosen.
+//It returns the paths of the layers files, from the lowest to the topmost one,
+//or an error if the image couldn't be downloaded.
+func PullImage(ctx context.Context, image, cacheDir string) ([]string, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	r := &registry{ref: ref}
+	manifest, err := r.manifest(ctx, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.MediaType == mediaTypeManifestList || manifest.MediaType == mediaTypeOCIIndex || len(manifest.Manifests) > 0 {
+		digest, err := manifest.platformDigest("linux", runtime.GOARCH)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", image, err)
+		}
+		if manifest, err = r.manifest(ctx, digest); err != nil {
+			return nil, err
+		}
+	}
+
+	layers := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		if layers[i], err = r.blob(ctx, layer.Digest, cacheDir); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+//An image manifest, or a list of the manifests of each platform (index)
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	Layers    []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+//It returns the digest of the manifest of the given platform.
+func (m *imageManifest) platformDigest(goos, goarch string) (string, error) {
+	for _, manifest := range m.Manifests {
+		if manifest.Platform.OS == goos && manifest.Platform.Architecture == goarch {
+			return manifest.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("the image is not available for %s/%s", goos, goarch)
+}
+
+//The session with the registry of an image
+type registry struct {
+	ref   ImageReference
+	token string
+}
+
+func (r *registry) manifest(ctx context.Context, reference string) (*imageManifest, error) {
+	accept := strings.Join([]string{mediaTypeManifest, mediaTypeManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}, ", ")
+	resp, err := r.get(ctx, "/manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var manifest imageManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of %s: %w", r.ref.Repository, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &manifest, nil
+}
+
+//It downloads the blob to the cache directory, checking its digest.
+//It returns the path of the blob file.
+func (r *registry) blob(ctx context.Context, digest, cacheDir string) (string, error) {
+	if !strings.HasPrefix(digest, "sha256:") || len(digest) != len("sha256:")+64 {
+		return "", fmt.Errorf("unsupported digest [%s]", digest)
+	}
+	path := filepath.Join(cacheDir, strings.Replace(digest, ":", "-", 1))
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	resp, err := r.get(ctx, "/blobs/"+digest, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := ioutil.TempFile(cacheDir, ".blob")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		return "", fmt.Errorf("the blob %s doesn't match its digest", digest)
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+//It gets a resource of the image's repository, asking for a token if the registry requires one.
+func (r *registry) get(ctx context.Context, resource, accept string) (*http.Response, error) {
+	scheme := "https"
+	if strings.HasPrefix(r.ref.Registry, "localhost") || strings.HasPrefix(r.ref.Registry, "127.0.0.1") {
+		scheme = "http"
+	}
+	endpoint := fmt.Sprintf("%s://%s/v2/%s%s", scheme, r.ref.Registry, r.ref.Repository, resource)
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+
+		resp, err := RegistryClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if r.token, err = r.requestToken(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("the registry has answered %s to GET %s", resp.Status, endpoint)
+		}
+		return resp, nil
+	}
+}
+
+//It asks the authorization service named in the challenge (the WWW-Authenticate
+//header of the registry) for an anonymous token to pull the repository.
+func (r *registry) requestToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge [%s]", challenge)
+	}
+	params := parseChallenge(strings.TrimPrefix(challenge, "Bearer "))
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication realm in [%s]", challenge)
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := RegistryClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the authorization service has answered %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return "", errors.New("the authorization service hasn't answered a token")
+	}
+	return body.Token, nil
+}
+
+//It parses the key="value" pairs of an authentication challenge.
+func parseChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	for challenge != "" {
+		eq := strings.Index(challenge, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(challenge[:eq])
+		rest := challenge[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = value
+		challenge = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return params
+}
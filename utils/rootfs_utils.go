@@ -0,0 +1,224 @@
+package utils
+
+//This file implements the unpacking of root filesystems: either a rootfs tarball
+//or the layers of an image (see PullImage), applied one over the other.
+//The entries are unpacked without privileges: their owners are not kept, and
+//the device files are skipped. Since the archives aren't trusted, no entry
+//is written outside the root directory, even through symbolic links.
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//The prefix of the entries that remove a file of the lower layers
+	whiteoutPrefix = ".wh."
+	//The entry that removes the content of its directory in the lower layers
+	opaqueWhiteout = ".wh..wh..opq"
+	//The maximum number of symbolic links followed when resolving a path
+	maxSymlinks = 255
+)
+
+//It unpacks the tar archive, which may be gzipped, into root.
+//The whiteouts of the archive (see the OCI image spec) remove the files
+//unpacked by the previous layers.
+//It returns an error if the archive is invalid or some entry couldn't be written.
+func UnpackLayer(r io.Reader, root string) error {
+	buffered := bufio.NewReader(r)
+	var reader io.Reader = buffered
+
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := unpackEntry(tr, header, root); err != nil {
+			return fmt.Errorf("unpacking [%s]: %w", header.Name, err)
+		}
+	}
+}
+
+//It unpacks the layers files, from the lowest to the topmost one, into root.
+func UnpackLayers(layers []string, root string) error {
+	for _, layer := range layers {
+		f, err := os.Open(layer)
+		if err != nil {
+			return err
+		}
+
+		err = UnpackLayer(f, root)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpackEntry(tr *tar.Reader, header *tar.Header, root string) error {
+	name := filepath.Clean("/" + filepath.FromSlash(header.Name))
+	if name == "/" {
+		return nil
+	}
+	dir, base := filepath.Split(name)
+
+	if base == opaqueWhiteout {
+		target, err := SecureJoin(root, dir)
+		if err != nil {
+			return err
+		}
+		return removeChildren(target)
+	}
+
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		target, err := SecureJoin(root, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		if err != nil {
+			return err
+		}
+		return RemoveAll(target)
+	}
+
+	target, err := SecureJoin(root, name)
+	if err != nil {
+		return err
+	}
+
+	//an entry replaces what a lower layer has in its place, except for directories
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+		if err := RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(header.Mode).Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		//the owner must be able to write the directory, or the upper layers couldn't change it
+		if err := os.MkdirAll(target, mode|0700); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode|0700)
+	case tar.TypeReg:
+		return writeFile(target, tr, mode)
+	case tar.TypeSymlink:
+		return os.Symlink(header.Linkname, target)
+	case tar.TypeLink:
+		source, err := SecureJoin(root, filepath.FromSlash(header.Linkname))
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	}
+	//device files and fifos can't be created without privileges
+	return nil
+}
+
+//It joins root and the path, resolving the symbolic links of the path as if root
+//were the filesystem root, so the result is always inside root. The last element
+//of the path is not resolved, since it is the one to be created or removed.
+func SecureJoin(root, path string) (string, error) {
+	pending := strings.Split(filepath.ToSlash(path), "/")
+	current := "/"
+	links := 0
+
+	for len(pending) > 0 {
+		element := pending[0]
+		pending = pending[1:]
+
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, element)
+		if len(pending) == 0 {
+			current = next
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links in " + path)
+		}
+
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(link, "/") {
+			current = "/"
+		}
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+
+	return filepath.Join(root, current), nil
+}
+
+//It removes the content of the directory, keeping the directory itself.
+func removeChildren(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//It removes the path and its children, as os.RemoveAll does, even
+//if some of its directories are not writable (e.g an unpacked /proc).
+func RemoveAll(path string) error {
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(file, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
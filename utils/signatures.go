@@ -0,0 +1,422 @@
+package utils
+
+//This file implements the signature of the requests sent to the server, in the style
+//of the HTTP Message Signatures (RFC 9421). The signature covers the request method,
+//its target URI, the digest of its body (Content-Digest, RFC 9530), the time it has
+//been created and a random nonce, so the server can tell a request has been neither
+//changed nor replayed. A signed request carries the headers below:
+//Content-Digest: sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+//Signature-Input: arrebol=("@method" "@target-uri" "content-digest");created=1618884473;
+//	keyid="<worker id>";alg="ed25519";nonce="b3k2pp5k7z-50gnwp.yemd"
+//Signature: arrebol=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:
+//Requests without body don't cover the content digest.
+//The responses of the server are signed the same way, but they cover the
+//response status code (@status) instead of the method and the target URI.
+//They also cover the method, the target URI and the signature of the request
+//that has got them (the components with the req parameter, e.g "@target-uri";req),
+//so a response can't be replayed to another request, even to the same URI:
+//Signature-Input: arrebol=("@status" "@method";req "@target-uri";req "signature";req;key="arrebol"
+//	"content-digest");created=1618884474;keyid="server";alg="ed25519";nonce="p0ns8uh5p_3ktjqalr7dzg"
+//The components are identified in this file by their name followed by their
+//parameters, as they are serialized but without the quotes (e.g @target-uri;req).
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SIGNATURE_KEY_PATTERN = "Signature"
+	SIGNATURE_INPUT_KEY   = "Signature-Input"
+	CONTENT_DIGEST_KEY    = "Content-Digest"
+	//The label of the worker's signature in the Signature and Signature-Input headers
+	SignatureLabel = "arrebol"
+)
+
+//The request components covered by the signature of a response (see SignResponse)
+var requestBinding = []string{"@method;req", "@target-uri;req", "signature;req;key=\"" + SignatureLabel + "\""}
+
+var (
+	//for test purpose
+	now = time.Now
+)
+
+//It signs the request with the private key of the worker id.
+//Params:
+//req - the request to be signed
+//workerId - the worker id, which names the key and is sent as keyid
+//body - the request body, or nil if there is none
+//It returns:
+//1. an error if the key couldn't be loaded or the request couldn't be signed
+//2. nil otherwise, once the request has got the signature headers
+func SignRequest(req *http.Request, workerId string, body []byte) error {
+	return sign(req.Header, workerId, body, []string{"@method", "@target-uri"}, requestComponent(req))
+}
+
+//It signs a response to req with the private key named keyName, covering its status
+//code, the digest of its body and the method, target URI and signature of req.
+//It is the way the server signs the tasks it dispatches (see VerifyResponse),
+//so it is useful to fake a server.
+//It returns nil once the header has got the signature fields, or an error otherwise.
+func SignResponse(header http.Header, statusCode int, body []byte, req *http.Request, keyName string) error {
+	if body == nil {
+		body = []byte{}
+	}
+	components := append([]string{"@status"}, requestBinding...)
+	return sign(header, keyName, body, components, responseComponent(header, statusCode, req))
+}
+
+//It checks the signature of a request signed by SignRequest.
+//Params:
+//req - the signed request
+//body - the request body, or nil if there is none
+//publicKey - the key of the signer
+//maxAge - how old the signature may be
+//It returns nil if the signature is valid, or an error otherwise.
+//Note that telling a replayed request apart also requires the caller
+//to remember the nonces seen in the last maxAge.
+func VerifyRequest(req *http.Request, body []byte, publicKey crypto.PublicKey, maxAge time.Duration) error {
+	return verify(req.Header, body, publicKey, maxAge, nil, requestComponent(req))
+}
+
+//It checks the signature of a response signed by SignResponse.
+//Params:
+//header, statusCode and body - the signed response
+//req - the signed request that has got the response
+//publicKey - the key of the signer
+//maxAge - how old the signature may be
+//It returns:
+//1. an error wrapping ErrMissingSignature if the response isn't signed
+//2. an error if the signature is invalid, expired, or doesn't cover the status code,
+//the body and the request (i.e it has been signed for another request)
+//3. nil otherwise
+func VerifyResponse(header http.Header, statusCode int, body []byte, req *http.Request, publicKey crypto.PublicKey, maxAge time.Duration) error {
+	if body == nil {
+		body = []byte{}
+	}
+	required := append([]string{"@status"}, requestBinding...)
+	return verify(header, body, publicKey, maxAge, required, responseComponent(header, statusCode, req))
+}
+
+//The error returned when a message has no signature at all
+var ErrMissingSignature = errors.New("the message is not signed")
+
+//It signs a message whose components are given by component. The signature covers
+//the components named by components and, if there is a body, its digest.
+func sign(header http.Header, keyName string, body []byte, components []string, component func(string) (string, error)) error {
+	privateKey, err := Keys.PrivateKey(keyName)
+	if err != nil {
+		return err
+	}
+
+	alg, err := AlgorithmOf(privateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if body != nil {
+		header.Set(CONTENT_DIGEST_KEY, contentDigest(body))
+		components = append(components, "content-digest")
+	}
+
+	params := fmt.Sprintf("(%s);created=%d;keyid=%q;alg=%q;nonce=%q", quoteAll(components),
+		now().Unix(), keyName, alg, base64.RawURLEncoding.EncodeToString(nonce))
+
+	base, err := signatureBase(components, params, component)
+	if err != nil {
+		return err
+	}
+
+	signature, err := signHTTPMessage(privateKey, []byte(base))
+	if err != nil {
+		return err
+	}
+
+	header.Set(SIGNATURE_INPUT_KEY, SignatureLabel+"="+params)
+	header.Set(SIGNATURE_KEY_PATTERN, SignatureLabel+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+	return nil
+}
+
+//It checks the signature of a message whose components are given by component.
+//The signature must cover the required components and, if there is a body, its digest.
+func verify(header http.Header, body []byte, publicKey crypto.PublicKey, maxAge time.Duration, required []string, component func(string) (string, error)) error {
+	if header.Get(SIGNATURE_INPUT_KEY) == "" || header.Get(SIGNATURE_KEY_PATTERN) == "" {
+		return ErrMissingSignature
+	}
+
+	components, params, err := parseSignatureInput(header.Get(SIGNATURE_INPUT_KEY))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range required {
+		if !contains(components, name) {
+			return errors.New("the signature doesn't cover " + name)
+		}
+	}
+
+	if body != nil {
+		if !contains(components, "content-digest") {
+			return errors.New("the signature doesn't cover the content digest")
+		}
+		if header.Get(CONTENT_DIGEST_KEY) != contentDigest(body) {
+			return errors.New("the content digest doesn't match the body")
+		}
+	}
+
+	created, err := signatureParam(params, "created")
+	if err != nil {
+		return err
+	}
+
+	createdAt, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return errors.New("invalid created parameter [" + created + "]")
+	}
+
+	if age := now().Sub(time.Unix(createdAt, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("the signature has been created %s ago", age)
+	}
+
+	signature, err := parseSignature(header.Get(SIGNATURE_KEY_PATTERN))
+	if err != nil {
+		return err
+	}
+
+	base, err := signatureBase(components, params, component)
+	if err != nil {
+		return err
+	}
+
+	alg, _ := signatureParam(params, "alg")
+	return verifyHTTPMessage(publicKey, alg, []byte(base), signature)
+}
+
+//It returns the value of the Content-Digest header of the body.
+func contentDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"
+}
+
+//It returns the values of the request components: the derived ones
+//(@method and @target-uri) and the header fields.
+func requestComponent(req *http.Request) func(string) (string, error) {
+	return func(id string) (string, error) {
+		switch id {
+		case "@method":
+			return req.Method, nil
+		case "@target-uri":
+			return req.URL.String(), nil
+		}
+		return headerComponent(req.Header, id)
+	}
+}
+
+//It returns the values of the response components: the derived one (@status), the header
+//fields and, when they have the req parameter, the components of req, the request
+//that has got the response.
+func responseComponent(header http.Header, statusCode int, req *http.Request) func(string) (string, error) {
+	return func(id string) (string, error) {
+		if strings.Contains(id, ";req") {
+			if req == nil {
+				return "", errors.New("the request of the response is unknown")
+			}
+			return requestComponent(req)(strings.Replace(id, ";req", "", 1))
+		}
+		if id == "@status" {
+			return strconv.Itoa(statusCode), nil
+		}
+		return headerComponent(header, id)
+	}
+}
+
+//It returns the value of a header field. With the key parameter (e.g signature;key="arrebol"),
+//the header is a dictionary and only the value of the member named key is returned.
+func headerComponent(header http.Header, id string) (string, error) {
+	name, key := id, ""
+	if i := strings.Index(id, ";key="); i >= 0 {
+		unquoted, err := strconv.Unquote(id[i+len(";key="):])
+		if err != nil {
+			return "", errors.New("invalid component " + id)
+		}
+		name, key = id[:i], unquoted
+	}
+
+	if strings.HasPrefix(name, "@") || strings.Contains(name, ";") {
+		return "", errors.New("unsupported component " + id)
+	}
+
+	values, ok := header[http.CanonicalHeaderKey(name)]
+	if !ok {
+		return "", errors.New("the signed header " + name + " is missing")
+	}
+
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.TrimSpace(value)
+	}
+	value := strings.Join(trimmed, ", ")
+	if key == "" {
+		return value, nil
+	}
+
+	for _, member := range strings.Split(value, ",") {
+		if member = strings.TrimSpace(member); strings.HasPrefix(member, key+"=") {
+			return strings.TrimPrefix(member, key+"="), nil
+		}
+	}
+	return "", errors.New("the signed header " + name + " has no " + key)
+}
+
+//It builds the signature base (RFC 9421, section 2.5): one line for each
+//covered component, followed by the signature parameters.
+func signatureBase(components []string, params string, component func(string) (string, error)) (string, error) {
+	var base strings.Builder
+	for _, id := range components {
+		value, err := component(id)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&base, "%s: %s\n", serializeComponent(id), value)
+	}
+	fmt.Fprintf(&base, "%q: %s", "@signature-params", params)
+	return base.String(), nil
+}
+
+//It parses the worker's entry of the Signature-Input header, e.g:
+//arrebol=("@method" "@target-uri");created=1618884473;keyid="1";alg="ed25519"
+//It returns the covered components and the signature parameters, as they are serialized.
+func parseSignatureInput(value string) ([]string, string, error) {
+	params := strings.TrimPrefix(value, SignatureLabel+"=")
+	end := strings.Index(params, ")")
+	if params == value || !strings.HasPrefix(params, "(") || end < 0 {
+		return nil, "", errors.New("invalid " + SIGNATURE_INPUT_KEY + " [" + value + "]")
+	}
+
+	var components []string
+	for _, item := range strings.Fields(params[1:end]) {
+		//the name is quoted, and so may be the values of its parameters (e.g "signature";key="arrebol")
+		closing := strings.Index(item[1:], `"`) + 1
+		if !strings.HasPrefix(item, `"`) || closing == 0 {
+			return nil, "", errors.New("invalid component " + item)
+		}
+		components = append(components, item[1:closing]+item[closing+1:])
+	}
+	return components, params, nil
+}
+
+//It returns the value of the signature parameter named name, unquoted.
+func signatureParam(params, name string) (string, error) {
+	for _, param := range strings.Split(params[strings.Index(params, ")")+1:], ";") {
+		if strings.HasPrefix(param, name+"=") {
+			value := strings.TrimPrefix(param, name+"=")
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted, nil
+			}
+			return value, nil
+		}
+	}
+	return "", errors.New("the signature parameter " + name + " is missing")
+}
+
+//It parses the worker's entry of the Signature header, e.g arrebol=:<base64>:
+func parseSignature(value string) ([]byte, error) {
+	encoded := strings.TrimPrefix(value, SignatureLabel+"=")
+	if encoded == value || len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+		return nil, errors.New("invalid " + SIGNATURE_KEY_PATTERN + " [" + value + "]")
+	}
+	return base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+}
+
+//It signs the signature base as RFC 9421 specifies for each algorithm (section 3.3).
+func signHTTPMessage(privateKey crypto.Signer, base []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		hash := sha512.Sum512(base)
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA512, hash[:], &rsa.PSSOptions{SaltLength: 64})
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(base)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		//r and s, as 32 bytes big-endian integers
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		return signature, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, base), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", privateKey)
+}
+
+func verifyHTTPMessage(publicKey crypto.PublicKey, alg string, base, signature []byte) error {
+	if expected, err := AlgorithmOf(publicKey); err != nil || alg != string(expected) {
+		return fmt.Errorf("unexpected signature algorithm [%s]", alg)
+	}
+
+	valid := false
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		hash := sha512.Sum512(base)
+		valid = rsa.VerifyPSS(key, crypto.SHA512, hash[:], signature, &rsa.PSSOptions{SaltLength: 64}) == nil
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(base)
+		if len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(key, hash[:], r, s)
+		}
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, base, signature)
+	}
+
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func quoteAll(components []string) string {
+	quoted := make([]string, len(components))
+	for i, id := range components {
+		quoted[i] = serializeComponent(id)
+	}
+	return strings.Join(quoted, " ")
+}
+
+//It serializes a component identifier as RFC 9421 does, e.g @target-uri;req to "@target-uri";req.
+func serializeComponent(id string) string {
+	name, params := id, ""
+	if i := strings.Index(id, ";"); i >= 0 {
+		name, params = id[:i], id[i:]
+	}
+	return strconv.Quote(name) + params
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package utils
+
+//This file implements the configuration of the TLS connections to the server.
+//By default, the server certificate is verified against the system CAs. It can
+//also be verified against a custom CA bundle (e.g a self-signed server), and the
+//worker can present its own certificate to the server (mutual TLS).
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	//PEM file with the CAs that the server certificate is verified against
+	TLSCAFileKey = "TLS_CA_FILE"
+	//PEM files with the worker's certificate and key, for mutual TLS
+	TLSCertFileKey = "TLS_CERT_FILE"
+	TLSKeyFileKey  = "TLS_KEY_FILE"
+	//The server name expected in its certificate, if it is not the endpoint host
+	TLSServerNameKey = "TLS_SERVER_NAME"
+	//The minimum TLS version: 1.2 (default) or 1.3
+	TLSMinVersionKey = "TLS_MIN_VERSION"
+)
+
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	MinVersion string
+}
+
+//It reads the TLS configuration from the environment.
+func TLSConfigFromEnv() TLSConfig {
+	return TLSConfig{
+		CAFile:     os.Getenv(TLSCAFileKey),
+		CertFile:   os.Getenv(TLSCertFileKey),
+		KeyFile:    os.Getenv(TLSKeyFileKey),
+		ServerName: os.Getenv(TLSServerNameKey),
+		MinVersion: os.Getenv(TLSMinVersionKey),
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//It builds the tls.Config described by c.
+//It returns an error if some file couldn't be loaded or some value is invalid.
+func (c TLSConfig) Build() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s [%s]; the available ones are 1.2 and 1.3", TLSMinVersionKey, c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		caPem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("there is no certificate in " + c.CAFile)
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("both %s and %s must be set for mutual TLS", TLSCertFileKey, TLSKeyFileKey)
+	}
+
+	if c.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+//It creates the client that connects the worker to the server through TLS, as c describes.
+//Requests to plain HTTP endpoints are not affected.
+//It returns nil and an error if the TLS configuration is invalid.
+func NewHTTPClient(c TLSConfig) (*http.Client, error) {
+	config, err := c.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -1,10 +1,41 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
-	"github.com/joho/godotenv"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/joho/godotenv"
 )
 
 const (
@@ -25,10 +56,10 @@ func TestGetPublicKey(t *testing.T) {
 	GenAccessKeys(WorkerId)
 
 	//exercise
-	publicKey := GetPublicKey(WorkerId)
+	publicKey, err := GetPublicKey(WorkerId)
 
 	//verification
-	if publicKey == nil {
+	if publicKey == nil || err != nil {
 		t.Errorf("Error on retrieving created public key")
 	}
 }
@@ -39,10 +70,10 @@ func TestGetPrivateKey(t *testing.T) {
 	GenAccessKeys(WorkerId)
 
 	//exercise
-	privateKey := GetPrivateKey(WorkerId)
+	privateKey, err := GetPrivateKey(WorkerId)
 
 	//verification
-	if privateKey == nil {
+	if privateKey == nil || err != nil {
 		t.Errorf("Error on retrieving created private key")
 	}
 }
@@ -51,6 +82,7 @@ func TestSignMessage(t *testing.T) {
 	//setup
 	setup()
 	GenAccessKeys(WorkerId)
+	publicKey, _ := GetPublicKey(WorkerId)
 
 	mockedData := make(map[string]string)
 
@@ -59,12 +91,1179 @@ func TestSignMessage(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error on mashalling the mockedData")
 	}
+	req, _ := http.NewRequest(http.MethodPost, "http://test-server:8000/v1/workers", bytes.NewReader(marshalledData))
 
 	//exercise
-	signedWorker, hashSum := SignMessage(GetPrivateKey(WorkerId), marshalledData)
+	err = SignRequest(req, WorkerId, marshalledData)
 
 	//verification
-	if !VerifySignature(GetPublicKey(WorkerId), hashSum, signedWorker) {
+	if err != nil || VerifyRequest(req, marshalledData, publicKey, time.Minute) != nil {
 		t.Errorf("Signature verification doesnt match the specifications")
 	}
 }
+
+type MockedClient struct {
+	responses []*http.Response
+	requests  []*http.Request
+}
+
+func (c *MockedClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req)
+	resp := c.responses[0]
+	c.responses = c.responses[1:]
+	if resp == nil {
+		return nil, errors.New("connection refused")
+	}
+	return resp, nil
+}
+
+func response(statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}
+}
+
+func setupRetry(responses ...*http.Response) *MockedClient {
+	client := &MockedClient{responses: responses}
+	Client = client
+	Keys = NewMemoryKeyStore()
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	Keys.Save(WorkerId, privateKey)
+	Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	sleep = func(context.Context, time.Duration) bool { return true }
+	return client
+}
+
+func TestGetRetriesOnServerErrors(t *testing.T) {
+	//setup
+	client := setupRetry(response(503), nil, response(200))
+
+	//exercise
+	resp, err := Get(context.Background(), WorkerId, "http://test-server:8000/v1", http.Header{})
+
+	//verification
+	if err != nil || resp.StatusCode != 200 {
+		t.Errorf("Expected the third attempt to succeed, got %v", err)
+	}
+
+	if len(client.requests) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(client.requests))
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	//setup
+	client := setupRetry(response(500), response(502), response(503), response(200))
+
+	//exercise
+	resp, err := Put(context.Background(), WorkerId, "payload", http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if err != nil || resp.StatusCode != 503 {
+		t.Errorf("Expected the last response after giving up, got %v", err)
+	}
+
+	if len(client.requests) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(client.requests))
+	}
+}
+
+func TestRetryAfterIsBoundedByMaxDelay(t *testing.T) {
+	//setup
+	busy := response(503)
+	busy.Header.Set("Retry-After", "3600")
+	client := setupRetry(busy, response(200))
+	var delays []time.Duration
+	sleep = func(ctx context.Context, d time.Duration) bool {
+		delays = append(delays, d)
+		return true
+	}
+
+	//exercise
+	resp, err := Get(context.Background(), WorkerId, "http://test-server:8000/v1", http.Header{})
+
+	//verification
+	if err != nil || resp.StatusCode != 200 || len(client.requests) != 2 {
+		t.Errorf("Expected the second attempt to succeed, got %v", err)
+	}
+
+	if len(delays) != 1 || delays[0] != Retry.MaxDelay {
+		t.Errorf("Expected a single delay of %s, got %v", Retry.MaxDelay, delays)
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	//setup
+	client := setupRetry(response(503), response(200))
+	sleep = sleepContext
+	Retry.BaseDelay, Retry.MaxDelay = time.Hour, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	//exercise
+	start := time.Now()
+	resp, err := Get(ctx, WorkerId, "http://test-server:8000/v1", http.Header{})
+
+	//verification
+	if err != nil || resp.StatusCode != 503 || len(client.requests) != 1 {
+		t.Errorf("Expected the first response once the context is done, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The retry has not been interrupted (%s)", elapsed)
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	//setup
+	client := setupRetry(response(401), response(200))
+
+	//exercise
+	resp, _ := Get(context.Background(), WorkerId, "http://test-server:8000/v1", http.Header{})
+
+	//verification
+	if resp.StatusCode != 401 || len(client.requests) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(client.requests))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		expectedMax := time.Second << uint(attempt-1)
+		if expectedMax > policy.MaxDelay {
+			expectedMax = policy.MaxDelay
+		}
+
+		if delay := policy.delay(attempt); delay < 0 || delay > expectedMax {
+			t.Errorf("Attempt %d: the delay %s is out of [0, %s]", attempt, delay, expectedMax)
+		}
+	}
+}
+
+func setupKeyStore(t *testing.T, store KeyStore) func() {
+	previousKeys, previousSize := Keys, KeyBitSize
+	Keys = store
+	KeyBitSize = 2048
+
+	return func() {
+		Keys = previousKeys
+		KeyBitSize = previousSize
+	}
+}
+
+func setupFileKeyStore(t *testing.T) (*FileKeyStore, func()) {
+	keysPath, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &FileKeyStore{Dir: keysPath}
+	teardown := setupKeyStore(t, store)
+
+	return store, func() {
+		teardown()
+		os.RemoveAll(keysPath)
+	}
+}
+
+func TestLoadOrGenAccessKeysReusesExistingKeys(t *testing.T) {
+	//setup
+	store, teardown := setupFileKeyStore(t)
+	defer teardown()
+	if err := LoadOrGenAccessKeys(WorkerId); err != nil {
+		t.Fatal(err)
+	}
+	privateKey, _ := ioutil.ReadFile(store.path(WorkerId, ".priv"))
+
+	//exercise
+	err := LoadOrGenAccessKeys(WorkerId)
+
+	//verification
+	if err != nil {
+		t.Error("Error on loading the existing keys: " + err.Error())
+	}
+
+	if reloaded, _ := ioutil.ReadFile(store.path(WorkerId, ".priv")); !bytes.Equal(privateKey, reloaded) {
+		t.Error("The existing private key has been replaced")
+	}
+}
+
+func TestLoadOrGenAccessKeysRecoversPublicKey(t *testing.T) {
+	//setup
+	store, teardown := setupFileKeyStore(t)
+	defer teardown()
+	LoadOrGenAccessKeys(WorkerId)
+	publicKey, _ := ioutil.ReadFile(store.path(WorkerId, ".pub"))
+	os.Remove(store.path(WorkerId, ".pub"))
+
+	//exercise
+	err := LoadOrGenAccessKeys(WorkerId)
+
+	//verification
+	if recovered, _ := ioutil.ReadFile(store.path(WorkerId, ".pub")); err != nil || !bytes.Equal(publicKey, recovered) {
+		t.Errorf("The public key has not been recovered: %v", err)
+	}
+}
+
+func TestLoadOrGenAccessKeysWithMismatchedKeys(t *testing.T) {
+	//setup
+	store, teardown := setupFileKeyStore(t)
+	defer teardown()
+	LoadOrGenAccessKeys(WorkerId)
+	otherKey, _ := GeneratePrivateKey(KeyBitSize)
+	otherPublicKey, _ := EncodePublicKeyToPem(otherKey.Public())
+	saveKey(otherPublicKey, store.path(WorkerId, ".pub"))
+
+	//exercise
+	err := LoadOrGenAccessKeys(WorkerId)
+
+	//verification
+	if err == nil {
+		t.Error("Expected an error on loading keys that don't match")
+	}
+}
+
+func TestPendingAccessKeys(t *testing.T) {
+	//setup
+	store, teardown := setupFileKeyStore(t)
+	defer teardown()
+	LoadOrGenAccessKeys(WorkerId)
+	currentKey, _ := ioutil.ReadFile(store.path(WorkerId, ".pub"))
+
+	//exercise
+	newKey, err := PendingAccessKeys(WorkerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DiscardPendingAccessKeys(WorkerId)
+	newKey, _ = PendingAccessKeys(WorkerId)
+	resumedKey, _ := PendingAccessKeys(WorkerId)
+	swapErr := SwapPendingAccessKeys(WorkerId)
+	swappedKey, _ := ioutil.ReadFile(store.path(WorkerId, ".pub"))
+	SwapPendingAccessKeys(WorkerId)
+	err = CommitPendingAccessKeys(WorkerId)
+
+	//verification
+	if !bytes.Equal(newKey, resumedKey) {
+		t.Error("The pending key pair of an unfinished rotation has not been reused")
+	}
+
+	if swapErr != nil || !bytes.Equal(newKey, swappedKey) {
+		t.Errorf("The pending key pair has not been swapped: %v", swapErr)
+	}
+
+	committedKey, _ := ioutil.ReadFile(store.path(WorkerId, ".pub"))
+	if err != nil || !bytes.Equal(newKey, committedKey) || bytes.Equal(currentKey, committedKey) {
+		t.Errorf("The pending key pair has not been committed: %v", err)
+	}
+
+	if _, err := os.Stat(store.path(WorkerId+pendingKeySuffix, ".priv")); !os.IsNotExist(err) {
+		t.Error("The pending private key has been left behind")
+	}
+}
+
+func TestFileKeyStore_SaveNeverLeavesAMismatchedPair(t *testing.T) {
+	//setup
+	store, teardown := setupFileKeyStore(t)
+	defer teardown()
+	LoadOrGenAccessKeys(WorkerId)
+	//the public key can't be moved into place over a directory
+	os.Remove(store.path(WorkerId, ".pub"))
+	os.Mkdir(store.path(WorkerId, ".pub"), 0700)
+	newKey, _ := GenerateKey(Ed25519)
+
+	//exercise
+	err := store.Save(WorkerId, newKey)
+
+	//verification
+	if err == nil {
+		t.Fatal("Expected an error on saving the public key")
+	}
+
+	if _, err := os.Stat(store.path(WorkerId, ".pub")); !os.IsNotExist(err) {
+		t.Error("The previous public key has been left next to the new private key")
+	}
+
+	if err := LoadOrGenAccessKeys(WorkerId); err != nil {
+		t.Fatal("Error on recovering the public key: " + err.Error())
+	}
+
+	publicKey, _ := store.PublicKey(WorkerId)
+	if !samePublicKey(publicKey, newKey.Public()) {
+		t.Error("The public key doesn't match the new private key")
+	}
+}
+
+func TestMemoryKeyStore(t *testing.T) {
+	//setup
+	store := NewMemoryKeyStore()
+	defer setupKeyStore(t, store)()
+
+	//exercise
+	_, missingErr := GetPrivateKey(WorkerId)
+	err := LoadOrGenAccessKeys(WorkerId)
+	publicKey, _ := GetPublicKey(WorkerId)
+	req, _ := http.NewRequest(http.MethodGet, "http://test-server:8000/v1/workers/1023", nil)
+	signErr := SignRequest(req, WorkerId, nil)
+
+	//verification
+	if !errors.Is(missingErr, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", missingErr)
+	}
+
+	if err != nil || signErr != nil || VerifyRequest(req, nil, publicKey, time.Minute) != nil {
+		t.Errorf("Error on signing with the generated keys: %v %v", err, signErr)
+	}
+
+	req.Header.Set(SIGNATURE_KEY_PATTERN, SignatureLabel+"=:RkFLRS1TSUdOQVRVUkU=:")
+	if VerifyRequest(req, nil, publicKey, time.Minute) == nil {
+		t.Error("An invalid signature has been accepted")
+	}
+}
+
+func TestEncryptedFileKeyStore(t *testing.T) {
+	//setup
+	fileStore, teardown := setupFileKeyStore(t)
+	defer teardown()
+	store := &EncryptedFileKeyStore{FileKeyStore: *fileStore, Passphrase: []byte("passphrase")}
+	Keys = store
+
+	//exercise
+	err := GenAccessKeys(WorkerId)
+	privateKey, loadErr := store.PrivateKey(WorkerId)
+	wrongPassphrase := &EncryptedFileKeyStore{FileKeyStore: *fileStore, Passphrase: []byte("wrong")}
+	_, wrongPassphraseErr := wrongPassphrase.PrivateKey(WorkerId)
+	_, plainErr := fileStore.PrivateKey(WorkerId)
+	fileStore.Save("plain", privateKey)
+	_, unencryptedErr := store.PrivateKey("plain")
+
+	//verification
+	if err != nil || loadErr != nil || privateKey == nil {
+		t.Errorf("Error on loading the encrypted private key: %v %v", err, loadErr)
+	}
+
+	if wrongPassphraseErr == nil {
+		t.Error("The private key has been decrypted with a wrong passphrase")
+	}
+
+	if plainErr == nil {
+		t.Error("The private key has been saved without encryption")
+	}
+
+	if unencryptedErr == nil {
+		t.Error("A private key saved without encryption has been accepted")
+	}
+}
+
+var algorithms = []Algorithm{RSAPSS, ECDSAP256, Ed25519}
+
+func TestKeyAlgorithms(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			//setup
+			_, teardown := setupFileKeyStore(t)
+			defer teardown()
+			KeyAlgorithm = alg
+			defer func() { KeyAlgorithm = RSAPSS }()
+			message := []byte("message")
+			req, _ := http.NewRequest(http.MethodPost, "http://test-server:8000/v1/workers", bytes.NewReader(message))
+
+			//exercise
+			err := LoadOrGenAccessKeys(WorkerId)
+			signErr := SignRequest(req, WorkerId, message)
+			header, headerErr := GetPublicKeyHeader(WorkerId)
+			publicKey, _ := GetPublicKey(WorkerId)
+
+			//verification
+			if err != nil || signErr != nil || headerErr != nil {
+				t.Fatalf("Error on using the %s keys: %v %v %v", alg, err, signErr, headerErr)
+			}
+
+			if signedAlg, _ := signatureParam(req.Header.Get(SIGNATURE_INPUT_KEY), "alg"); signedAlg != string(alg) {
+				t.Errorf("Expected a %s signature, got %s", alg, signedAlg)
+			}
+
+			if err := VerifyRequest(req, message, publicKey, time.Minute); err != nil {
+				t.Error("Error on verifying the signature: " + err.Error())
+			}
+
+			if VerifyRequest(req, []byte("another message"), publicKey, time.Minute) == nil {
+				t.Error("The signature of another message has been accepted")
+			}
+
+			//the server must find the same algorithm in both headers
+			if !strings.HasPrefix(header, string(alg)+" ") {
+				t.Errorf("The Public-Key header [%s] doesn't name the algorithm", header)
+			}
+		})
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	if alg, err := ParseAlgorithm(""); alg != RSAPSS || err != nil {
+		t.Errorf("Expected the default algorithm, got %s %v", alg, err)
+	}
+
+	if alg, err := ParseAlgorithm("ed25519"); alg != Ed25519 || err != nil {
+		t.Errorf("Expected ed25519, got %s %v", alg, err)
+	}
+
+	if _, err := ParseAlgorithm("dsa"); err == nil {
+		t.Error("Expected an error on parsing an unknown algorithm")
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			//setup
+			defer setupKeyStore(t, NewMemoryKeyStore())()
+			KeyAlgorithm = alg
+			defer func() { KeyAlgorithm = RSAPSS }()
+			GenAccessKeys(WorkerId)
+			publicKey, _ := GetPublicKey(WorkerId)
+			body := []byte(`{"Vcpu":1}`)
+			req, _ := http.NewRequest(http.MethodPut, "http://test-server:8000/v1/workers/1023", bytes.NewReader(body))
+
+			//exercise
+			err := SignRequest(req, WorkerId, body)
+
+			//verification
+			if err != nil {
+				t.Fatal("Error on signing the request: " + err.Error())
+			}
+
+			if err := VerifyRequest(req, body, publicKey, time.Minute); err != nil {
+				t.Error("Error on verifying the request: " + err.Error())
+			}
+
+			if VerifyRequest(req, []byte(`{"Vcpu":64}`), publicKey, time.Minute) == nil {
+				t.Error("A request with another body has been accepted")
+			}
+
+			req.Method = http.MethodDelete
+			if VerifyRequest(req, body, publicKey, time.Minute) == nil {
+				t.Error("A request with another method has been accepted")
+			}
+		})
+	}
+}
+
+func TestSignRequestHeaders(t *testing.T) {
+	//setup
+	defer setupKeyStore(t, NewMemoryKeyStore())()
+	KeyAlgorithm = Ed25519
+	defer func() { KeyAlgorithm = RSAPSS }()
+	GenAccessKeys(WorkerId)
+	now = func() time.Time { return time.Unix(1618884473, 0) }
+	defer func() { now = time.Now }()
+	req, _ := http.NewRequest(http.MethodGet, "http://test-server:8000/v1/workers/1023", nil)
+
+	//exercise
+	SignRequest(req, WorkerId, nil)
+
+	//verification
+	input := req.Header.Get(SIGNATURE_INPUT_KEY)
+	expectedPrefix := `arrebol=("@method" "@target-uri");created=1618884473;keyid="1023";alg="ed25519";nonce="`
+	if !strings.HasPrefix(input, expectedPrefix) {
+		t.Errorf("Unexpected %s [%s]", SIGNATURE_INPUT_KEY, input)
+	}
+
+	if req.Header.Get(CONTENT_DIGEST_KEY) != "" {
+		t.Error("A request without body has got a content digest")
+	}
+
+	signature := req.Header.Get(SIGNATURE_KEY_PATTERN)
+	if _, err := parseSignature(signature); err != nil {
+		t.Errorf("Unexpected %s [%s]: %v", SIGNATURE_KEY_PATTERN, signature, err)
+	}
+}
+
+func TestVerifyRequestWithExpiredSignature(t *testing.T) {
+	//setup
+	defer setupKeyStore(t, NewMemoryKeyStore())()
+	KeyAlgorithm = Ed25519
+	defer func() { KeyAlgorithm = RSAPSS }()
+	GenAccessKeys(WorkerId)
+	publicKey, _ := GetPublicKey(WorkerId)
+	req, _ := http.NewRequest(http.MethodGet, "http://test-server:8000/v1/workers/1023", nil)
+	now = func() time.Time { return time.Now().Add(-time.Hour) }
+	SignRequest(req, WorkerId, nil)
+	now = time.Now
+
+	//exercise
+	err := VerifyRequest(req, nil, publicKey, 5*time.Minute)
+
+	//verification
+	if err == nil {
+		t.Error("An expired signature has been accepted")
+	}
+}
+
+func TestRetriedRequestsAreSignedAgain(t *testing.T) {
+	//setup
+	client := setupRetry(response(503), response(200))
+
+	//exercise
+	Put(context.Background(), WorkerId, "payload", http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if len(client.requests) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(client.requests))
+	}
+
+	first, second := client.requests[0].Header.Get(SIGNATURE_INPUT_KEY), client.requests[1].Header.Get(SIGNATURE_INPUT_KEY)
+	if first == "" || first == second {
+		t.Errorf("The attempts have the same signature input [%s]", first)
+	}
+}
+
+//It makes the worker's key a new one of the given algorithm, in a memory key store.
+//It returns a function that restores the previous key store.
+func benchmarkKeys(b *testing.B, alg Algorithm) func() {
+	previousKeys := Keys
+	store := NewMemoryKeyStore()
+	Keys = store
+
+	privateKey, err := GenerateKey(alg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store.Save(WorkerId, privateKey)
+	return func() { Keys = previousKeys }
+}
+
+func BenchmarkSignRequest(b *testing.B) {
+	body := []byte(`{"Vcpu":1,"Ram":1024,"QueueID":1}`)
+	for _, alg := range algorithms {
+		b.Run(string(alg), func(b *testing.B) {
+			defer benchmarkKeys(b, alg)()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest(http.MethodPost, "http://test-server:8000/v1/workers", bytes.NewReader(body))
+				if err := SignRequest(req, WorkerId, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVerifyRequest(b *testing.B) {
+	body := []byte(`{"Vcpu":1,"Ram":1024,"QueueID":1}`)
+	for _, alg := range algorithms {
+		b.Run(string(alg), func(b *testing.B) {
+			defer benchmarkKeys(b, alg)()
+			publicKey, _ := GetPublicKey(WorkerId)
+			req, _ := http.NewRequest(http.MethodPost, "http://test-server:8000/v1/workers", bytes.NewReader(body))
+			SignRequest(req, WorkerId, body)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := VerifyRequest(req, body, publicKey, time.Minute); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyResponse(t *testing.T) {
+	//setup
+	defer setupKeyStore(t, NewMemoryKeyStore())()
+	KeyAlgorithm = Ed25519
+	defer func() { KeyAlgorithm = RSAPSS }()
+	GenAccessKeys("server")
+	GenAccessKeys("worker")
+	publicKey, _ := GetPublicKey("server")
+	body := []byte(`{"ID":1}`)
+	header := http.Header{}
+
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://test-server:8000/v1/workers/worker/queues/1/tasks", nil)
+		if err := SignRequest(req, "worker", nil); err != nil {
+			t.Fatal("Error on signing the request: " + err.Error())
+		}
+		return req
+	}
+	req := newRequest()
+
+	//exercise
+	err := SignResponse(header, 200, body, req, "server")
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on signing the response: " + err.Error())
+	}
+
+	if err := VerifyResponse(header, 200, body, req, publicKey, time.Minute); err != nil {
+		t.Error("Error on verifying the response: " + err.Error())
+	}
+
+	if !strings.Contains(header.Get(SIGNATURE_INPUT_KEY), `"@target-uri";req "signature";req;key="arrebol"`) {
+		t.Errorf("The signature doesn't cover the request: %s", header.Get(SIGNATURE_INPUT_KEY))
+	}
+
+	if VerifyResponse(header, 201, body, req, publicKey, time.Minute) == nil {
+		t.Error("A response with another status code has been accepted")
+	}
+
+	if VerifyResponse(header, 200, []byte(`{"ID":2}`), req, publicKey, time.Minute) == nil {
+		t.Error("A response with another body has been accepted")
+	}
+
+	//the same request again, but with its own signature
+	if VerifyResponse(header, 200, body, newRequest(), publicKey, time.Minute) == nil {
+		t.Error("A response replayed to another request has been accepted")
+	}
+
+	unbound := http.Header{}
+	sign(unbound, "server", body, []string{"@status"}, responseComponent(unbound, 200, nil))
+	if VerifyResponse(unbound, 200, body, req, publicKey, time.Minute) == nil {
+		t.Error("A response not bound to its request has been accepted")
+	}
+
+	if SignResponse(http.Header{}, 200, body, nil, "server") == nil {
+		t.Error("A response has been signed without its request")
+	}
+
+	if err := VerifyResponse(http.Header{}, 200, body, req, publicKey, time.Minute); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("Expected ErrMissingSignature, got %v", err)
+	}
+}
+
+//It writes the content to a temporary file and returns its path.
+func tempFile(t *testing.T, content []byte) string {
+	file, err := ioutil.TempFile("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write(content)
+	return file.Name()
+}
+
+//It creates a self-signed client certificate and returns
+//the paths of its certificate and key PEM files.
+func clientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: WorkerId},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyPem, _ := EncodePrivKeyToPem(privateKey)
+
+	return certificate, tempFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), tempFile(t, keyPem)
+}
+
+func TestFindShell(t *testing.T) {
+	//exercise
+	var tried []string
+	shell, err := FindShell(func(shell string) (bool, error) {
+		tried = append(tried, shell)
+		return shell == "/busybox/sh", nil
+	})
+	_, noShellErr := FindShell(func(string) (bool, error) { return false, nil })
+	_, stopErr := FindShell(func(string) (bool, error) { return false, context.Canceled })
+
+	//verification
+	if err != nil || shell != "/busybox/sh" || len(tried) != len(Shells) {
+		t.Errorf("Expected to fall back to /busybox/sh after trying %v, got %s %v", tried, shell, err)
+	}
+
+	if !errors.Is(noShellErr, ErrNoShell) {
+		t.Errorf("Expected ErrNoShell, got %v", noShellErr)
+	}
+
+	if stopErr != context.Canceled {
+		t.Errorf("Expected the search to stop with the probe error, got %v", stopErr)
+	}
+}
+
+//The command run by the fake Docker API: its output and its exit code
+type fakeExec struct {
+	stdout, stderr string
+	exitCode       int
+}
+
+//It starts a fake Docker API whose execs run the commands through run.
+//Each exec is reported as running on its first inspection, as the docker
+//daemon may do right after the output is over.
+func fakeDockerAPI(t *testing.T, run func(cmd []string) fakeExec) (*client.Client, func()) {
+	var mu sync.Mutex
+	var execs []fakeExec
+	inspections := map[int]int{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.25/containers/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.25/containers/container-id/exec" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such container"}`)
+			return
+		}
+		var config types.ExecConfig
+		json.NewDecoder(r.Body).Decode(&config)
+		mu.Lock()
+		execs = append(execs, run(config.Cmd))
+		id := len(execs) - 1
+		mu.Unlock()
+		fmt.Fprintf(w, `{"Id": "%d"}`, id)
+	})
+	mux.HandleFunc("/v1.25/exec/", func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		var action string
+		fmt.Sscanf(strings.Replace(strings.TrimPrefix(r.URL.Path, "/v1.25/exec/"), "/", " ", 1), "%d %s", &id, &action)
+		mu.Lock()
+		exec := execs[id]
+		if action == "json" {
+			inspections[id]++
+		}
+		running := inspections[id] == 1
+		mu.Unlock()
+
+		if action == "json" && running {
+			fmt.Fprint(w, `{"Running": true, "ExitCode": 0}`)
+			return
+		}
+		if action == "json" {
+			fmt.Fprintf(w, `{"Running": false, "ExitCode": %d}`, exec.exitCode)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		stdcopy.NewStdWriter(buf, stdcopy.Stdout).Write([]byte(exec.stdout))
+		stdcopy.NewStdWriter(buf, stdcopy.Stderr).Write([]byte(exec.stderr))
+		buf.Flush()
+	})
+	server := httptest.NewServer(mux)
+
+	cli, err := client.NewClient("tcp://"+server.Listener.Addr().String(), "1.25", nil, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return cli, server.Close
+}
+
+func TestExecCommand(t *testing.T) {
+	//setup
+	cli, closeAPI := fakeDockerAPI(t, func(cmd []string) fakeExec {
+		return fakeExec{stdout: strings.Join(cmd, " "), stderr: "warning", exitCode: 3}
+	})
+	defer closeAPI()
+
+	//exercise
+	result, err := ExecCommand(context.Background(), cli, "container-id", []string{"/bin/sh", "-c", "exit 3"}, time.Minute)
+	_, missingErr := ExecCommand(context.Background(), cli, "missing-id", []string{"true"}, time.Minute)
+
+	//verify
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ExitCode != 3 {
+		t.Errorf("Expected the exit code 3, got %d", result.ExitCode)
+	}
+
+	if string(result.Stdout) != "/bin/sh -c exit 3" || string(result.Stderr) != "warning" {
+		t.Errorf("Expected the stdout and the stderr apart, got %q and %q", result.Stdout, result.Stderr)
+	}
+
+	if missingErr == nil {
+		t.Error("Expected an error on executing a command in a missing container")
+	}
+}
+
+func TestDetectShell(t *testing.T) {
+	//setup
+	cli, closeAPI := fakeDockerAPI(t, func(cmd []string) fakeExec {
+		if cmd[0] == "/bin/sh" {
+			return fakeExec{}
+		}
+		return fakeExec{stderr: "exec: not found", exitCode: 127}
+	})
+	defer closeAPI()
+
+	//exercise
+	shell, err := DetectShell(context.Background(), cli, "container-id")
+
+	//verify
+	if err != nil || shell != "/bin/sh" {
+		t.Errorf("Expected to fall back to /bin/sh, got %s %v", shell, err)
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	//setup
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := tempFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	defer os.Remove(caFile)
+
+	cases := []struct {
+		name   string
+		config TLSConfig
+		valid  bool
+	}{
+		{"custom CA", TLSConfig{CAFile: caFile}, true},
+		{"system CAs", TLSConfig{}, false},
+		{"server name override", TLSConfig{CAFile: caFile, ServerName: "example.com"}, true},
+		{"wrong server name", TLSConfig{CAFile: caFile, ServerName: "arrebol.example"}, false},
+	}
+
+	for _, c := range cases {
+		client, err := NewHTTPClient(c.config)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		//exercise
+		resp, err := client.Get(server.URL)
+
+		//verification
+		if c.valid && (err != nil || resp.StatusCode != http.StatusOK) {
+			t.Errorf("%s: error on connecting to the server: %v", c.name, err)
+		}
+
+		if !c.valid && err == nil {
+			t.Errorf("%s: the connection should have failed", c.name)
+		}
+	}
+}
+
+func TestNewHTTPClientWithMutualTLS(t *testing.T) {
+	//setup
+	certificate, certFile, keyFile := clientCertificate(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(certificate)
+	server.StartTLS()
+	defer server.Close()
+	caFile := tempFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	defer os.Remove(caFile)
+
+	withCertificate, _ := NewHTTPClient(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	withoutCertificate, _ := NewHTTPClient(TLSConfig{CAFile: caFile})
+
+	//exercise
+	resp, err := withCertificate.Get(server.URL)
+	_, refusedErr := withoutCertificate.Get(server.URL)
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on connecting with the client certificate: " + err.Error())
+	}
+
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != WorkerId {
+		t.Errorf("The server has got the certificate of [%s]", body)
+	}
+
+	if refusedErr == nil {
+		t.Error("The connection without the client certificate should have failed")
+	}
+}
+
+func TestNewHTTPClientWithMinVersion(t *testing.T) {
+	//setup
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	caFile := tempFile(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	defer os.Remove(caFile)
+
+	client, _ := NewHTTPClient(TLSConfig{CAFile: caFile, MinVersion: "1.3"})
+
+	//exercise
+	_, err := client.Get(server.URL)
+
+	//verification
+	if err == nil {
+		t.Error("The connection to a TLS 1.2 server should have failed")
+	}
+
+	if _, err := NewHTTPClient(TLSConfig{MinVersion: "1.0"}); err == nil {
+		t.Error("Expected an error on setting an unsupported version")
+	}
+
+	if _, err := NewHTTPClient(TLSConfig{CertFile: "worker.crt"}); err == nil {
+		t.Error("Expected an error on setting a certificate without key")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	//setup
+	//bigger than the chunks in which it is read
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.25/containers/container-id/archive" || r.URL.Query().Get("path") != "/arrebol/output" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString([]byte(`{"name": "output"}`)))
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "output", Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+		tw.Close()
+	}))
+	defer server.Close()
+	cli, err := client.NewClient("tcp://"+server.Listener.Addr().String(), "1.25", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//exercise
+	whole, err := ReadFile(context.Background(), cli, "container-id", "/arrebol/output", 0)
+	tail, tailErr := ReadFile(context.Background(), cli, "container-id", "/arrebol/output", 15)
+	_, missingErr := ReadFile(context.Background(), cli, "container-id", "/arrebol/missing", 15)
+
+	//verify
+	if err != nil || !bytes.Equal(whole, content) {
+		t.Errorf("Expected the whole file, got %d bytes %v", len(whole), err)
+	}
+
+	if tailErr != nil || string(tail) != "567890123456789" {
+		t.Errorf("Expected the last 15 bytes of the file, got %q %v", tail, tailErr)
+	}
+
+	if missingErr == nil {
+		t.Error("Expected an error on reading a missing file")
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("", "tar-src")
+	destDir, _ := ioutil.TempDir("", "tar-dest")
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(destDir)
+
+	binary := []byte{0, 1, '\'', '"', '\n', 0xff, '\\', 'n'}
+	os.MkdirAll(filepath.Join(srcDir, "bin", "scripts"), 0750)
+	ioutil.WriteFile(filepath.Join(srcDir, "bin", "data"), binary, 0600)
+	ioutil.WriteFile(filepath.Join(srcDir, "bin", "scripts", "run.sh"), []byte("echo 'it works'\n"), 0755)
+
+	var archive bytes.Buffer
+	if err := tarPath(&archive, filepath.Join(srcDir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(&archive, destDir); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		path    string
+		mode    os.FileMode
+		content []byte
+	}{
+		{"bin", 0750 | os.ModeDir, nil},
+		{"bin/scripts", 0750 | os.ModeDir, nil},
+		{"bin/data", 0600, binary},
+		{"bin/scripts/run.sh", 0755, []byte("echo 'it works'\n")},
+	}
+
+	for _, check := range checks {
+		file := filepath.Join(destDir, filepath.FromSlash(check.path))
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != check.mode {
+			t.Errorf("Expected mode %s for %s, got %s", check.mode, check.path, info.Mode())
+		}
+		if info.IsDir() {
+			continue
+		}
+		content, _ := ioutil.ReadFile(file)
+		if !bytes.Equal(content, check.content) {
+			t.Errorf("Expected content %q for %s, got %q", check.content, check.path, content)
+		}
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected ImageReference
+	}{
+		{"ubuntu", ImageReference{DefaultRegistry, "library/ubuntu", "latest"}},
+		{"ubuntu:20.04", ImageReference{DefaultRegistry, "library/ubuntu", "20.04"}},
+		{"ufcglsd/worker:1.0", ImageReference{DefaultRegistry, "ufcglsd/worker", "1.0"}},
+		{"registry.example.com/team/app", ImageReference{"registry.example.com", "team/app", "latest"}},
+		{"localhost:5000/app:dev", ImageReference{"localhost:5000", "app", "dev"}},
+		{"alpine@sha256:abc", ImageReference{DefaultRegistry, "library/alpine", "sha256:abc"}},
+	}
+
+	for _, test := range tests {
+		ref, err := ParseImageReference(test.image)
+		if err != nil {
+			t.Errorf("Unexpected error on parsing %s: %s", test.image, err)
+		}
+		if ref != test.expected {
+			t.Errorf("Expected %+v for %s, got %+v", test.expected, test.image, ref)
+		}
+	}
+
+	for _, image := range []string{"", "ubuntu:", "Ubuntu"} {
+		if _, err := ParseImageReference(image); err == nil {
+			t.Errorf("Expected an error on parsing [%s]", image)
+		}
+	}
+}
+
+type layerEntry struct {
+	header  tar.Header
+	content string
+}
+
+func layer(t *testing.T, entries ...layerEntry) *bytes.Buffer {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range entries {
+		entry.header.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entry.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &archive
+}
+
+func TestUnpackLayer(t *testing.T) {
+	parent, _ := ioutil.TempDir("", "rootfs")
+	defer RemoveAll(parent)
+	root := filepath.Join(parent, "root")
+	os.Mkdir(root, 0755)
+
+	lower := layer(t,
+		layerEntry{tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "etc/kept", Mode: 0644}, "kept"},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "etc/removed", Mode: 0644}, "removed"},
+		layerEntry{tar.Header{Typeflag: tar.TypeLink, Name: "etc/linked", Linkname: "etc/kept"}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeDir, Name: "cache/", Mode: 0555}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "cache/old", Mode: 0644}, "old"},
+		layerEntry{tar.Header{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "../../.."}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeChar, Name: "null", Devmajor: 1, Devminor: 3}, ""},
+	)
+	var upper bytes.Buffer
+	gz := gzip.NewWriter(&upper)
+	io.Copy(gz, layer(t,
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.removed"}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "cache/.wh..wh..opq"}, ""},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "cache/new", Mode: 0644}, "new"},
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "escape/escaped", Mode: 0644}, "escaped"},
+	))
+	gz.Close()
+
+	for _, archive := range []io.Reader{lower, &upper} {
+		if err := UnpackLayer(archive, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checks := map[string]string{
+		"etc/kept":    "kept",
+		"etc/linked":  "kept",
+		"etc/removed": "",
+		"cache/old":   "",
+		"cache/new":   "new",
+		"escaped":     "escaped",
+		"null":        "",
+	}
+	for path, expected := range checks {
+		content, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+		if expected == "" && !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to exist", path)
+		}
+		if expected != "" && string(content) != expected {
+			t.Errorf("Expected content %q for %s, got %q (%v)", expected, path, content, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+		t.Error("The entry has been unpacked outside the root through a symbolic link")
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	layerContent := []byte("the layer")
+	layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(layerContent))
+	blobRequests := 0
+
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"token": "secret"}`))
+	})
+	mux.HandleFunc("/v2/team/app/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/1.0":
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			fmt.Fprintf(w, `{"manifests": [{"digest": "sha256:other", "platform": {"os": "windows", "architecture": %q}},
+				{"digest": "sha256:mine", "platform": {"os": "linux", "architecture": %q}}]}`, runtime.GOARCH, runtime.GOARCH)
+		case "/v2/team/app/manifests/sha256:mine":
+			fmt.Fprintf(w, `{"mediaType": %q, "layers": [{"digest": %q}]}`, mediaTypeManifest, layerDigest)
+		case "/v2/team/app/blobs/" + layerDigest:
+			blobRequests++
+			w.Write(layerContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	cacheDir, _ := ioutil.TempDir("", "images")
+	defer os.RemoveAll(cacheDir)
+	image := strings.TrimPrefix(server.URL, "http://") + "/team/app:1.0"
+
+	for i := 0; i < 2; i++ {
+		layers, err := PullImage(context.Background(), image, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != 1 {
+			t.Fatalf("Expected one layer, got %v", layers)
+		}
+		if content, _ := ioutil.ReadFile(layers[0]); !bytes.Equal(content, layerContent) {
+			t.Errorf("Unexpected layer content: %q", content)
+		}
+	}
+
+	if blobRequests != 1 {
+		t.Errorf("Expected the layer to be downloaded once, got %d downloads", blobRequests)
+	}
+
+	if _, err := PullImage(context.Background(), strings.TrimPrefix(server.URL, "http://")+"/team/app:2.0", cacheDir); err == nil {
+		t.Error("Expected an error on pulling a missing image")
+	}
+}
@@ -1,15 +1,23 @@
-#!/bin/bash
+#!/bin/sh
 
-# Read the task script file and execute one command at a time, saving your exitcodes in the .ts.ec file.
+# It only relies on POSIX sh features, so it runs on images without bash (e.g alpine, busybox).
+# Read the task script file and execute one command at a time.
 # Each command executed is written to the .cmds file.
+# The progress of the execution is written to the .events file, one JSON object per line:
+# {"event":"start","index":<i>,"time":<unix seconds>} when the command at index i starts, and
+# {"event":"end","index":<i>,"time":<unix seconds>,"exitCode":<code>} when it ends.
+# The events carry no signal: a command killed by a signal has the exit code that the shell gives
+# it (128 + signal), which can't be told apart from a command that has exited with that code.
+# The commands that the worker kills (on a timeout or a cancellation) don't end here, since the
+# executor is killed along with them; the worker records the signal of those (see Command.Signal).
+# In debug mode, the events are also written to the stdout, so they can be followed as they happen.
 # Use -tsf= or --task_filepath= to input the task file path (Required).
-# Use the flag -d or --debug to store .out and .err from execution (Optional).
+# Use the flag -d or --debug to store the .out and .err of each command (Optional).
+# The output of the command at index i (starting from 0) is stored in the .ts.i.out and .ts.i.err files.
 
 # This flag does the execution not stop on non-zero exit code commands
 set +e
 
-WORK_DIR=/arrebol
-
 for i in "$@"
 do
 	case $i in
@@ -33,27 +41,42 @@ then
 	exit 17
 fi
 
+# the files of the execution are written next to the task file (e.g /arrebol, inside a container)
+WORK_DIR=$(dirname $__TASK_SCRIPT_FILEPATH)
 TS_FILENAME=$(basename $__TASK_SCRIPT_FILEPATH)
 
-__EXIT_CODES=$WORK_DIR/$TS_FILENAME.ec
-rm $__EXIT_CODES
-touch $__EXIT_CODES
+__EVENTS=$WORK_DIR/$TS_FILENAME.events
+rm -f $__EVENTS
+touch $__EVENTS
 
 __COMMANDS=$WORK_DIR/$TS_FILENAME.cmds
-rm $__COMMANDS
+rm -f $__COMMANDS
 touch $__COMMANDS
 
-if [ -n "$DEBUG" ];
-then
-	rm $WORK_DIR/$TS_FILENAME.out
-	exec 1> $WORK_DIR/$TS_FILENAME.out
-	rm $WORK_DIR/$TS_FILENAME.err
-	exec 2> $WORK_DIR/$TS_FILENAME.err
-fi
+__OUTPUT=/dev/stdout
+__ERROR=/dev/stderr
+__INDEX=0
+
+# It appends an event to the .events file and, in debug mode, writes it to the stdout
+__event() {
+	echo "$1" >> $__EVENTS
+	if [ -n "$DEBUG" ];
+	then
+		echo "$1"
+	fi
+}
 
 while IFS= read -r __line || [ -n "$__line" ]; do
 	set +e
-    eval $__line
-	  echo $__line >> $__COMMANDS
-    echo "$?" >> $__EXIT_CODES
+	if [ -n "$DEBUG" ];
+	then
+		__OUTPUT=$WORK_DIR/$TS_FILENAME.$__INDEX.out
+		__ERROR=$WORK_DIR/$TS_FILENAME.$__INDEX.err
+	fi
+	__event "$(printf '{"event":"start","index":%d,"time":%s}' $__INDEX "$(date +%s)")"
+	eval $__line > $__OUTPUT 2> $__ERROR
+	__EXIT_CODE=$?
+	echo $__line >> $__COMMANDS
+	__event "$(printf '{"event":"end","index":%d,"time":%s,"exitCode":%d}' $__INDEX "$(date +%s)" $__EXIT_CODE)"
+	__INDEX=$((__INDEX + 1))
 done < $__TASK_SCRIPT_FILEPATH
\ No newline at end of file
@@ -0,0 +1,250 @@
+package worker
+
+//This module implements all steps needed in the task execution inside a container, as follows:
+//Init a container, which includes download the task's image; create and start the container;
+//move the executor script to the work dir inside the container.
+//Send the task commands as a file to the container
+//Execute the task, which includes invoking the executor script passing the commands file as
+//arg and following the events of each command.
+//Interrupt the execution, when it is cancelled, by stopping the container.
+//Track the execution, by retrieving the exit code and the start and finish times of each command.
+//Collect the stdout and stderr of each command, before the container is removed.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+)
+
+//The runner that executes each task inside its own container
+type DockerRunner struct {
+	Cli *client.Client
+	Cid string
+	//The shell available inside the container, which runs the task script
+	shell string
+	//The resources that the task's container is allowed to use.
+	//Zero values mean no limit.
+	Limits TaskLimits
+	//The number of commands of the task
+	commands int
+	tracker
+}
+
+//It creates the task's container and sends the task's commands to it.
+func (e *DockerRunner) Prepare(ctx context.Context, task *Task) error {
+	defer e.markReady()
+	image := task.DockerImage
+
+	log.Println("Creating container with image: " + image)
+	containerName := fmt.Sprintf("%v", task.ID) + "-" + strconv.Itoa(time.Now().Second())
+
+	memory := int64(e.Limits.Ram) * 1024 * 1024
+	config := utils.ContainerConfig{
+		Name:       containerName,
+		Image:      image,
+		Mounts:     []mount.Mount{},
+		NanoCPUs:   int64(e.Limits.Vcpu * 1e9),
+		Memory:     memory,
+		MemorySwap: memory,
+		PidsLimit:  e.Limits.PidsLimit,
+	}
+
+	e.commands = len(task.Commands)
+	if err := e.init(ctx, config); err != nil {
+		return err
+	}
+	return e.send(ctx, task)
+}
+
+func (e *DockerRunner) init(ctx context.Context, config utils.ContainerConfig) error {
+	exists, err := utils.CheckImage(ctx, e.Cli, config.Image)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		progress, err := utils.Pull(ctx, e.Cli, config.Image)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, progress)
+		progress.Close()
+		if err != nil {
+			return err
+		}
+	}
+	cid, err := utils.CreateContainer(ctx, e.Cli, config)
+
+	if err != nil {
+		return err
+	}
+	//from now on, the container must be removed at the end of the execution
+	e.Cid = cid
+	err = utils.StartContainer(ctx, e.Cli, cid)
+
+	if err != nil {
+		return err
+	}
+
+	shell, err := utils.DetectShell(ctx, e.Cli, cid)
+
+	if err != nil {
+		return err
+	}
+	e.shell = shell
+
+	err = utils.MakeDir(ctx, e.Cli, cid, "/arrebol", 0755)
+
+	if err != nil {
+		log.Println("Error on creating /arrebol folder")
+		return err
+	}
+
+	taskScriptExecutorPath := os.Getenv("BIN_PATH") + "/" + TaskScriptExecutorFileName
+
+	return utils.CopyToContainer(ctx, e.Cli, cid, taskScriptExecutorPath, "/arrebol")
+}
+
+//It sends the task's commands to a file
+//inside the container.
+//Params:
+//task - the task whose commands will be sent
+//It returns:
+//1. an error if the task commands couldn't be sent
+//2. nil if no error happened
+func (e *DockerRunner) send(ctx context.Context, task *Task) error {
+	err := utils.WriteFile(ctx, e.Cli, e.Cid, taskScript(task), "/arrebol/"+taskScriptFileName, 0644)
+	return err
+}
+
+//It runs the task script, following the events that the
+//task script executor writes to its stdout as they happen.
+func (e *DockerRunner) Run(ctx context.Context) error {
+	taskScriptFilePath := "/arrebol/" + taskScriptFileName
+	cmd := fmt.Sprintf(RunTaskScriptCommandPattern, e.shell, "/arrebol/"+TaskScriptExecutorFileName, taskScriptFilePath)
+	log.Printf("Executing command [%s] on container [%s]", cmd, e.Cid)
+
+	var stderr bytes.Buffer
+	exitCode, err := utils.ExecStream(ctx, e.Cli, e.Cid, []string{e.shell, "-c", cmd}, 0, &eventStream{tracker: &e.tracker, commands: e.commands}, &stderr)
+
+	if err != nil {
+		return err
+	}
+
+	if exitCode != 0 {
+		return fmt.Errorf("the task script has exited with code %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+//Tracks the task execution by reading the exit code, start and
+//finish times of each command that has already been started from the
+//.events file, which is the reliable source of the results (see Results).
+//Until Prepare is over (e.g while the image is pulled), there is no container to
+//read it from, and once the execution is over (and the container is gone), it
+//keeps returning the results of its last successful tracking.
+//It returns:
+//1. The results of the last successful tracking and an error,
+//if it couldn't access the .events file in the container
+//2. The results of the started commands and nil.
+func (e *DockerRunner) Track() ([]CommandResult, error) {
+	if e.finished() || !e.isReady() {
+		return e.Results(), nil
+	}
+
+	eventsFilePath := "/arrebol/" + taskScriptFileName + ".events"
+	dat, err := utils.ReadFile(context.Background(), e.Cli, e.Cid, eventsFilePath, 0)
+
+	if err != nil {
+		log.Println(err)
+		return e.Results(), err
+	}
+
+	return e.update(parseEvents(dat, e.commands)), nil
+}
+
+//It stops the container, which is kept until Cleanup, so the
+//results and outputs of the commands can still be read.
+func (e *DockerRunner) Cancel() error {
+	if e.Cid == "" {
+		return nil
+	}
+	return utils.StopContainer(e.Cli, e.Cid)
+}
+
+//It collects the results and outputs of the commands, then removes the container.
+func (e *DockerRunner) Cleanup() error {
+	if e.Cid == "" {
+		e.finish(nil)
+		return nil
+	}
+
+	if _, err := e.Track(); err != nil {
+		log.Println(err)
+	}
+	e.finish(e.collectOutputs())
+	utils.StopContainer(e.Cli, e.Cid)
+	return utils.RemoveContainer(e.Cli, e.Cid)
+}
+
+//It reads the stdout and stderr of each command of the task,
+//which are kept until the container is removed.
+//Each output is limited to its last MaxCommandOutputSize bytes.
+func (e *DockerRunner) collectOutputs() []CommandOutput {
+	outputs := make([]CommandOutput, e.commands)
+	for i := range outputs {
+		outputFilePath := fmt.Sprintf("/arrebol/%s.%d", taskScriptFileName, i)
+
+		stdout, err := utils.ReadFile(context.Background(), e.Cli, e.Cid, outputFilePath+".out", MaxCommandOutputSize)
+		if err != nil {
+			log.Println(err)
+		}
+
+		stderr, err := utils.ReadFile(context.Background(), e.Cli, e.Cid, outputFilePath+".err", MaxCommandOutputSize)
+		if err != nil {
+			log.Println(err)
+		}
+
+		outputs[i] = CommandOutput{Stdout: string(stdout), Stderr: string(stderr)}
+	}
+	return outputs
+}
+
+//It returns the docker client shared by the worker's docker runners, creating it on the first call.
+func (w *Worker) dockerClient() (*client.Client, error) {
+	w.dockerMutex.Lock()
+	defer w.dockerMutex.Unlock()
+
+	if w.docker == nil {
+		w.docker = utils.NewDockerClient(os.Getenv(WorkerNodeAddressKey))
+		if w.docker == nil {
+			return nil, errors.New("the docker client couldn't be created")
+		}
+	}
+	return w.docker, nil
+}
+
+//It releases the resources shared by the worker's tasks, i.e the docker client.
+//It must only be called once no task is running.
+func (w *Worker) Close() error {
+	w.dockerMutex.Lock()
+	defer w.dockerMutex.Unlock()
+
+	if w.docker == nil {
+		return nil
+	}
+	err := w.docker.Close()
+	w.docker = nil
+	return err
+}
@@ -0,0 +1,59 @@
+package worker
+
+//This module implements a runner that doesn't execute the commands at all.
+//It goes through the same steps as the other runners, so the rest of the
+//worker (e.g the reports to the server) can be exercised without docker.
+
+import (
+	"context"
+	"time"
+)
+
+//The runner that pretends to execute the tasks
+type FakeRunner struct {
+	//The exit code of each raw command. The missing ones exit with zero.
+	ExitCodes map[string]int
+	//How long each command takes
+	CommandDuration time.Duration
+	//The error returned by Prepare, if any
+	PrepareErr error
+	//The raw commands of the task
+	commands []string
+	tracker
+}
+
+func (r *FakeRunner) Prepare(ctx context.Context, task *Task) error {
+	for _, cmd := range task.Commands {
+		r.commands = append(r.commands, cmd.RawCommand)
+	}
+	return r.PrepareErr
+}
+
+//It starts and ends each command in turn, as the task script executor would.
+func (r *FakeRunner) Run(ctx context.Context) error {
+	for i, cmd := range r.commands {
+		r.apply(commandEvent{Event: "start", Index: i, Time: time.Now().Unix()})
+
+		select {
+		case <-time.After(r.CommandDuration):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		r.apply(commandEvent{Event: "end", Index: i, Time: time.Now().Unix(), ExitCode: r.ExitCodes[cmd]})
+	}
+	return nil
+}
+
+func (r *FakeRunner) Track() ([]CommandResult, error) {
+	return r.Results(), nil
+}
+
+func (r *FakeRunner) Cancel() error {
+	return nil
+}
+
+func (r *FakeRunner) Cleanup() error {
+	r.finish(make([]CommandOutput, len(r.commands)))
+	return nil
+}
@@ -0,0 +1,205 @@
+package worker
+
+//This module implements the local execution of a task file (see the run-local command),
+//so that a task can be debugged without a server: the worker doesn't join it, no
+//signature is checked and no report is sent. Instead, the commands are printed to
+//the terminal as they start and end, along with their outputs once the task is over.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//The exit codes of a local execution whose task hasn't finished (see LocalExitCode)
+const (
+	LocalFailedExitCode    = 1
+	LocalTimedOutExitCode  = 124
+	LocalCancelledExitCode = 130
+)
+
+//It reads a task from a JSON file or, if its extension is .yaml or .yml, from a YAML one.
+//The fields are named as in the JSON of the task (e.g DockerImage, Commands, RawCommand),
+//regardless of the format and their case.
+//It returns an error if the file couldn't be read or the task has no commands.
+func ReadTaskFile(path string) (*Task, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if content, err = yamlToJSON(content); err != nil {
+			return nil, fmt.Errorf("invalid task file [%s]: %w", path, err)
+		}
+	}
+
+	var task Task
+	if err := json.Unmarshal(content, &task); err != nil {
+		return nil, fmt.Errorf("invalid task file [%s]: %w", path, err)
+	}
+
+	if len(task.Commands) == 0 {
+		return nil, fmt.Errorf("the task file [%s] has no commands", path)
+	}
+	return &task, nil
+}
+
+//It converts a YAML document to JSON, so that it is decoded as the tasks sent by the server.
+func yamlToJSON(content []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+
+	document, err := jsonValue(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+//It replaces the maps decoded from YAML, whose keys may be of any type, by maps of strings.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("the key [%v] is not a string", key)
+			}
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = item
+		}
+		return object, nil
+	case []interface{}:
+		for i, item := range value {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = item
+		}
+	}
+	return value, nil
+}
+
+//The reporter that prints the commands to the terminal as they start and end
+type ConsoleReporter struct {
+	Out io.Writer
+	//The states of the commands and the progress of the task in the previous report
+	states   []CommandState
+	progress int
+}
+
+//It prints the commands whose state has changed since the previous report,
+//then the task's progress, if it has changed as well.
+//It never asks for the task to be cancelled.
+func (r *ConsoleReporter) Report(ctx context.Context, task *Task) (bool, error) {
+	states := make([]CommandState, len(task.Commands))
+	for i, cmd := range task.Commands {
+		states[i] = cmd.State
+		previous := CmdNotStarted
+		if i < len(r.states) {
+			previous = r.states[i]
+		}
+		if cmd.State == previous {
+			continue
+		}
+
+		prefix := fmt.Sprintf("[%d/%d]", i+1, len(task.Commands))
+		if previous == CmdNotStarted {
+			fmt.Fprintf(r.Out, "%s started: %s\n", prefix, cmd.RawCommand)
+		}
+		if cmd.State != CmdRunning {
+			fmt.Fprintf(r.Out, "%s %s\n", prefix, describeCommandEnd(cmd))
+		}
+	}
+	r.states = states
+
+	if task.Progress != r.progress {
+		fmt.Fprintf(r.Out, "Progress: %d%%\n", task.Progress)
+		r.progress = task.Progress
+	}
+	return false, nil
+}
+
+//It executes the task on this node, printing its progress to out as it happens
+//and, at the end, the output of each command and the task's final state.
+//It returns the exit code of the execution (see LocalExitCode).
+func (w *Worker) RunLocal(ctx context.Context, task *Task, out io.Writer) int {
+	runner := w.Runner
+	if runner == "" {
+		runner = RunnerDocker
+	}
+	fmt.Fprintf(out, "Running the task [%v] (%d commands) on the %s runner\n", task.ID, len(task.Commands), runner)
+
+	w.RunTask(ctx, task, &ConsoleReporter{Out: out})
+
+	for i, cmd := range task.Commands {
+		fmt.Fprintf(out, "--- [%d/%d] %s: %s\n", i+1, len(task.Commands), cmd.RawCommand, describeCommandEnd(cmd))
+		printOutput(out, "stdout", cmd.Stdout)
+		printOutput(out, "stderr", cmd.Stderr)
+	}
+	fmt.Fprintf(out, "The task has ended with the state %s\n", task.State)
+
+	return LocalExitCode(task)
+}
+
+func printOutput(out io.Writer, name, output string) {
+	if output == "" {
+		return
+	}
+	if !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	fmt.Fprintf(out, "%s:\n%s", name, output)
+}
+
+//It describes how the command has ended, or that it hasn't. Only the commands killed
+//by the worker itself are described by a signal; the others, by their exit code.
+func describeCommandEnd(cmd *Command) string {
+	switch {
+	case cmd.State == CmdNotStarted:
+		return "not started"
+	case cmd.State == CmdTimedOut:
+		return "timed out"
+	case cmd.Signal != 0:
+		return fmt.Sprintf("interrupted (killed by signal %d)", cmd.Signal)
+	case cmd.State == CmdRunning:
+		return "interrupted"
+	}
+	return fmt.Sprintf("exited with code %d", cmd.ExitCode)
+}
+
+//It returns the exit code of a local execution of the task, as the shells do:
+//when the task has finished, the exit code of its first failed command, or zero;
+//otherwise, one of the LocalFailedExitCode, LocalTimedOutExitCode and
+//LocalCancelledExitCode, according to the task's state.
+func LocalExitCode(task *Task) int {
+	switch task.State {
+	case TaskFinished:
+		for _, cmd := range task.Commands {
+			if cmd.ExitCode != 0 {
+				return cmd.ExitCode
+			}
+		}
+		return 0
+	case TaskTimedOut:
+		return LocalTimedOutExitCode
+	case TaskCancelled:
+		return LocalCancelledExitCode
+	}
+	return LocalFailedExitCode
+}
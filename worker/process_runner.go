@@ -0,0 +1,240 @@
+package worker
+
+//This module implements the execution of a task as plain processes of the worker host,
+//so no docker daemon is needed. Each task gets a scratch directory, in which its
+//commands are run through the task script executor, and which is removed at the end.
+//Note that the commands are not isolated from the host, and the task's DockerImage
+//and limits are ignored, so this runner must only run trusted tasks.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+)
+
+//The runner that executes each task as local processes
+type ProcessRunner struct {
+	//The directory in which the scratch directories are created.
+	//Empty means the system's temporary directory.
+	BaseDir string
+	//The shell that runs the task script. Empty means /bin/sh.
+	Shell string
+	//The scratch directory of the task
+	dir string
+	//The directory of the task files (see bin/task-script-executor.sh)
+	workDir string
+	//The number of commands of the task
+	commands int
+	//The process of the task script, while it runs
+	cmd      *exec.Cmd
+	cmdMutex sync.Mutex
+	tracker
+}
+
+//It creates the task's scratch directory and writes the task's commands to it.
+func (r *ProcessRunner) Prepare(ctx context.Context, task *Task) error {
+	defer r.markReady()
+	dir, err := ioutil.TempDir(r.BaseDir, fmt.Sprintf("arrebol-task-%v-", task.ID))
+
+	if err != nil {
+		return err
+	}
+	//from now on, the directory must be removed at the end of the execution
+	r.dir = dir
+	r.workDir = dir
+	r.commands = len(task.Commands)
+
+	return ioutil.WriteFile(filepath.Join(dir, taskScriptFileName), taskScript(task), 0644)
+}
+
+//It runs the task script inside the scratch directory, following
+//the events that the task script executor writes to its stdout.
+func (r *ProcessRunner) Run(ctx context.Context) error {
+	shell := r.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	taskScriptExecutorPath := filepath.Join(os.Getenv("BIN_PATH"), TaskScriptExecutorFileName)
+
+	cmd := exec.Command(shell, taskScriptExecutorPath, "-d", "-tsf="+filepath.Join(r.workDir, taskScriptFileName))
+	cmd.Dir = r.workDir
+	setProcessGroup(cmd)
+	return r.execute(ctx, cmd)
+}
+
+//It runs the command that runs the task script, following its events, until it
+//exits or ctx is done. In the latter case, it is killed along with its children.
+func (r *ProcessRunner) execute(ctx context.Context, cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stdout = &eventStream{tracker: &r.tracker, commands: r.commands}
+	cmd.Stderr = &stderr
+
+	log.Printf("Executing command [%s] in [%s]", strings.Join(cmd.Args, " "), r.workDir)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	r.cmdMutex.Lock()
+	r.cmd = cmd
+	r.cmdMutex.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("the task script has failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	case <-ctx.Done():
+		if err := r.Cancel(); err != nil {
+			log.Println(err)
+		}
+		<-exited
+		return ctx.Err()
+	}
+}
+
+//Tracks the task execution by reading the .events file
+//from the scratch directory (see DockerRunner.Track).
+func (r *ProcessRunner) Track() ([]CommandResult, error) {
+	//the scratch directory may not exist yet
+	if r.finished() || !r.isReady() {
+		return r.Results(), nil
+	}
+
+	dat, err := readTaskFile(filepath.Join(r.workDir, taskScriptFileName+".events"), eventsFileLimit(r.commands))
+
+	if err != nil {
+		log.Println(err)
+		return r.Results(), err
+	}
+
+	return r.update(parseEvents(dat, r.commands)), nil
+}
+
+//It kills the task script and every command started by it.
+func (r *ProcessRunner) Cancel() error {
+	r.cmdMutex.Lock()
+	defer r.cmdMutex.Unlock()
+
+	if r.cmd == nil || r.cmd.Process == nil {
+		return nil
+	}
+	return killProcessGroup(r.cmd)
+}
+
+//It collects the results and outputs of the commands, then removes the scratch directory.
+func (r *ProcessRunner) Cleanup() error {
+	if r.dir == "" {
+		r.finish(nil)
+		return nil
+	}
+
+	if _, err := r.Track(); err != nil {
+		log.Println(err)
+	}
+	r.finish(r.collectOutputs())
+	return utils.RemoveAll(r.dir)
+}
+
+//It reads the stdout and stderr of each command of the task.
+//Each output is limited to its last MaxCommandOutputSize bytes.
+func (r *ProcessRunner) collectOutputs() []CommandOutput {
+	outputs := make([]CommandOutput, r.commands)
+	for i := range outputs {
+		outputFilePath := filepath.Join(r.workDir, fmt.Sprintf("%s.%d", taskScriptFileName, i))
+		outputs[i] = CommandOutput{
+			Stdout: readTail(outputFilePath+".out", MaxCommandOutputSize),
+			Stderr: readTail(outputFilePath+".err", MaxCommandOutputSize),
+		}
+	}
+	return outputs
+}
+
+//It reads the last limit bytes of the file (see openTaskFile).
+//If it can't be read, the content is empty.
+func readTail(file string, limit int64) string {
+	f, info, err := openTaskFile(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if info.Size() > limit {
+		f.Seek(info.Size()-limit, io.SeekStart)
+	}
+
+	//the file may still grow
+	content, err := ioutil.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		log.Println(err)
+	}
+	return string(content)
+}
+
+//It reads the whole file (see openTaskFile).
+//It returns an error if the file is bigger than limit bytes.
+func readTaskFile(file string, limit int64) ([]byte, error) {
+	f, _, err := openTaskFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("the task file [%s] is bigger than %d bytes", file, limit)
+	}
+	return content, nil
+}
+
+//It returns the biggest .events file of a task with the given number of commands:
+//a start and an end event per command.
+func eventsFileLimit(commands int) int64 {
+	return int64(2*commands) * maxEventSize
+}
+
+//It opens a file written by the task, refusing symbolic links and anything but a regular
+//file, so that a task can't make the worker read a file of the host (e.g from inside a
+//sandbox) nor block it forever (e.g on a FIFO). The file is checked once it is open,
+//so it can't be replaced in the meantime.
+//It returns the open file and its info, or an error.
+func openTaskFile(file string) (*os.File, os.FileInfo, error) {
+	for _, path := range []string{filepath.Dir(file), file} {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return nil, nil, fmt.Errorf("the task file [%s] is a symbolic link", path)
+		}
+	}
+
+	f, err := os.OpenFile(file, taskFileFlags, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("the task file [%s] is not a regular file", file)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
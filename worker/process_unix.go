@@ -0,0 +1,24 @@
+// +build !windows
+
+package worker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//The flags of the files written by the task (see openTaskFile): a symbolic link
+//fails to open, even if it replaces the file after it has been checked, and a FIFO
+//opens without waiting for a writer, so that it can be refused.
+const taskFileFlags = syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+
+//It makes the command the leader of a new process group,
+//so that it can be killed along with its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+//It kills the process group led by the command.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
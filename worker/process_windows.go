@@ -0,0 +1,18 @@
+package worker
+
+import (
+	"os"
+	"os/exec"
+)
+
+//The flags of the files written by the task (see openTaskFile).
+//Windows has no flag to refuse symbolic links, so they are only checked before opening.
+const taskFileFlags = os.O_RDONLY
+
+//There are no process groups to set on windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+//It kills the command only, since there are no process groups on windows.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
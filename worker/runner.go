@@ -0,0 +1,345 @@
+package worker
+
+//This module defines how a task is executed, regardless of where its commands run.
+//A TaskRunner is the backend of one execution: it prepares the environment of the
+//task, runs its commands, tracks them and removes the environment at the end.
+//The available backends, selected by the worker's Runner, are:
+//docker - each task runs inside its own container (see docker_runner.go)
+//process - each task runs as local processes in a scratch directory (see process_runner.go)
+//sandbox - each task runs inside its own rootless sandbox, on linux only (see sandbox_runner.go)
+//fake - the commands are not run at all, which is only available to tests (see fake_runner.go)
+//The docker, process and sandbox backends run the commands through the task script executor
+//(see bin/task-script-executor.sh), whose events are followed as they happen.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	TaskScriptExecutorFileName  = "task-script-executor.sh"
+	RunTaskScriptCommandPattern = "%s %s -d -tsf=%s"
+	//The name of the file that holds the task's commands, one per line
+	taskScriptFileName = "task-id.ts"
+	//Maximum amount of bytes kept from each command's stdout and stderr.
+	//When the output is bigger than that, only its end is kept.
+	MaxCommandOutputSize = 64 * 1024
+)
+
+//The signal that kills the running commands when the worker interrupts a task (see TaskRunner.Cancel):
+//the process and sandbox runners kill their process group, and the commands of a stopped
+//container are killed by the kernel along with its init, which is the only one to get a SIGTERM.
+const killSignal = int(syscall.SIGKILL)
+
+//The available runners (see Worker.Runner)
+const (
+	RunnerDocker  = "docker"
+	RunnerProcess = "process"
+	RunnerSandbox = "sandbox"
+	RunnerFake    = "fake"
+)
+
+type TaskRunner interface {
+	//It creates the environment in which the task runs and sends its commands to it.
+	//Once it has been called, Cleanup must be called as well, even if it fails.
+	Prepare(ctx context.Context, task *Task) error
+	//It runs the task's commands, returning when they are over or as soon as ctx is done.
+	//It returns an error if the commands couldn't be run.
+	Run(ctx context.Context) error
+	//It reads the results of the started commands from the environment. Once the
+	//execution is over, it keeps returning the results of its last successful tracking.
+	Track() ([]CommandResult, error)
+	//It returns the results known so far, without accessing the environment.
+	Results() []CommandResult
+	//It returns a channel that receives a value whenever a command starts or ends.
+	//Changes that happen before the previous one is noticed are merged.
+	Changes() <-chan struct{}
+	//It stops the running commands, keeping the environment until Cleanup.
+	Cancel() error
+	//It collects the outputs of the commands and removes the environment.
+	Cleanup() error
+	//It returns the outputs of the commands, once the environment has been cleaned up.
+	Outputs() []CommandOutput
+}
+
+//It checks if kind is one of the available runners. An empty kind stands for RunnerDocker.
+func CheckRunner(kind string) error {
+	switch kind {
+	case "", RunnerDocker, RunnerProcess:
+		return nil
+	case RunnerFake:
+		return errors.New("the fake runner is only available to tests")
+	case RunnerSandbox:
+		if !sandboxAvailable {
+			return errSandboxUnavailable
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown runner [%s]; the available ones are: %s, %s, %s",
+		kind, RunnerDocker, RunnerProcess, RunnerSandbox)
+}
+
+//It executes the task through the runner and sends the task's final state
+//through statesChanges when the execution is over and its environment is gone.
+//The execution is interrupted as soon as ctx is done; in that case, the final state is
+//TaskTimedOut, if the ctx deadline has been exceeded, or TaskCancelled otherwise.
+func Execute(ctx context.Context, runner TaskRunner, task *Task, statesChanges chan<- TaskState) {
+	state := TaskFinished
+	if err := runner.Prepare(ctx, task); err != nil {
+		log.Println(err)
+		state = TaskFailed
+	} else if err := runner.Run(ctx); err != nil {
+		log.Println(err)
+		state = TaskFailed
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("The execution of the task [%v] has timed out", task.ID)
+		state = TaskTimedOut
+	} else if ctx.Err() != nil {
+		log.Printf("The execution of the task [%v] has been interrupted: %s", task.ID, ctx.Err())
+		state = TaskCancelled
+	}
+
+	if ctx.Err() != nil {
+		if err := runner.Cancel(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if err := runner.Cleanup(); err != nil {
+		log.Println(err)
+	}
+	statesChanges <- state
+}
+
+//The execution state of a command
+type CommandResult struct {
+	ExitCode  int
+	StartedAt time.Time
+	//It is zero while the command is running
+	FinishedAt time.Time
+}
+
+func (r CommandResult) Finished() bool {
+	return !r.FinishedAt.IsZero()
+}
+
+//The end of the stdout and stderr of a command (see MaxCommandOutputSize)
+type CommandOutput struct {
+	Stdout string
+	Stderr string
+}
+
+//It fills the Stdout and Stderr of the task's commands
+//with the outputs collected at the end of the execution.
+func setOutputs(task *Task, outputs []CommandOutput) {
+	for i, output := range outputs {
+		if i < len(task.Commands) {
+			task.Commands[i].Stdout = output.Stdout
+			task.Commands[i].Stderr = output.Stderr
+		}
+	}
+}
+
+//It keeps the state that every runner shares: the results of the commands,
+//which are updated as the events come, and the outputs collected at the end.
+//It implements the Results, Changes and Outputs methods of TaskRunner.
+type tracker struct {
+	//The results of the last successful tracking, or of the last event received
+	results []CommandResult
+	//It receives a value whenever a command starts or ends (see Changes)
+	changes chan struct{}
+	//The output of each command, collected at the end of the execution
+	outputs []CommandOutput
+	//It is set when the execution is over and the results won't change anymore
+	done bool
+	//It is set once Prepare is over, so that the runner's fields set by it may be read
+	//by Track, which is called from another goroutine (see markReady)
+	ready bool
+	mutex sync.Mutex
+}
+
+//It updates the results according to the event and notifies the change.
+func (t *tracker) apply(event commandEvent) {
+	t.mutex.Lock()
+	if t.done {
+		t.mutex.Unlock()
+		return
+	}
+	//the previous results may be in use, so they are not modified
+	results := append([]CommandResult(nil), t.results...)
+	t.results = applyEvent(results, event)
+	changes := t.changesChan()
+	t.mutex.Unlock()
+
+	select {
+	case changes <- struct{}{}:
+	default:
+		//there is a change waiting to be noticed already
+	}
+}
+
+//It replaces the results by the tracked ones, unless the execution is over.
+//It returns the current results.
+func (t *tracker) update(results []CommandResult) []CommandResult {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.done {
+		t.results = results
+	}
+	return t.results
+}
+
+//It checks if the results have been frozen by finish.
+func (t *tracker) finished() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.done
+}
+
+//It tells that Prepare is over, even if it has failed. The fields set by Prepare
+//may only be read from other goroutines once isReady returns true.
+func (t *tracker) markReady() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.ready = true
+}
+
+func (t *tracker) isReady() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.ready
+}
+
+//It freezes the tracking results and keeps the collected outputs,
+//so they can still be retrieved after the environment is removed.
+func (t *tracker) finish(outputs []CommandOutput) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.done = true
+	t.outputs = outputs
+}
+
+func (t *tracker) Changes() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.changesChan()
+}
+
+func (t *tracker) changesChan() chan struct{} {
+	if t.changes == nil {
+		t.changes = make(chan struct{}, 1)
+	}
+	return t.changes
+}
+
+func (t *tracker) Results() []CommandResult {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.results
+}
+
+func (t *tracker) Outputs() []CommandOutput {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.outputs
+}
+
+//The longest line of the task script executor's output taken as an event.
+//The commands may write to that output as well, so longer lines are dropped.
+const maxEventSize = 1024
+
+//It receives the output of the task script executor and applies
+//each event, once its line is complete, to the tracker's results.
+type eventStream struct {
+	tracker *tracker
+	//The number of commands of the task; the events of other indexes are dropped
+	commands int
+	pending  []byte
+	//It is set while the rest of a line longer than maxEventSize is dropped
+	dropping bool
+}
+
+func (s *eventStream) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			if len(s.pending) > maxEventSize {
+				s.pending = s.pending[:0]
+				s.dropping = true
+			}
+			return len(p), nil
+		}
+		var event commandEvent
+		if s.dropping {
+			s.dropping = false
+		} else if err := json.Unmarshal(s.pending[:i], &event); err == nil && validEvent(event, s.commands) {
+			s.tracker.apply(event)
+		}
+		s.pending = s.pending[i+1:]
+	}
+}
+
+//An entry of the .events file, written by the task script executor
+//when a command starts and ends. It has no signal (see Command.Signal).
+type commandEvent struct {
+	Event    string `json:"event"`
+	Index    int    `json:"index"`
+	Time     int64  `json:"time"`
+	ExitCode int    `json:"exitCode"`
+}
+
+//It parses the content of the .events file into the results of the started commands,
+//given the number of commands of the task. The lines that can't be parsed (e.g the one
+//being written) are skipped, and so are the events of the commands the task doesn't have,
+//since the file is in reach of the commands.
+func parseEvents(content []byte, commands int) []CommandResult {
+	results := make([]CommandResult, 0)
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var event commandEvent
+		if err := json.Unmarshal(line, &event); err == nil && validEvent(event, commands) {
+			results = applyEvent(results, event)
+		}
+	}
+	return results
+}
+
+//It checks if the event is about one of the task's commands.
+func validEvent(event commandEvent, commands int) bool {
+	return event.Index >= 0 && event.Index < commands
+}
+
+//It sets the start or the end of the event's command in the results.
+//The event must be valid (see validEvent).
+func applyEvent(results []CommandResult, event commandEvent) []CommandResult {
+	for len(results) <= event.Index {
+		results = append(results, CommandResult{})
+	}
+
+	switch event.Event {
+	case "start":
+		results[event.Index].StartedAt = time.Unix(event.Time, 0)
+	case "end":
+		results[event.Index].FinishedAt = time.Unix(event.Time, 0)
+		results[event.Index].ExitCode = event.ExitCode
+	}
+	return results
+}
+
+//It returns the content of the task script file: the raw commands of the task, one per line.
+func taskScript(task *Task) []byte {
+	var rawCmds bytes.Buffer
+	for i := 0; i < len(task.Commands); i++ {
+		rawCmds.WriteString(task.Commands[i].RawCommand + "\n")
+	}
+	return rawCmds.Bytes()
+}
@@ -0,0 +1,192 @@
+package worker
+
+//This module implements the sandbox itself. The worker binary runs itself again
+//(see SandboxInitCommand) as the first process of the new namespaces, in which
+//the user that runs the worker is mapped to root. That process mounts /proc and a
+//minimal /dev in the task's root filesystem, makes it the root of the sandbox and
+//then runs the task script, exiting as it exits. When it is killed, the kernel
+//kills every process of the sandbox along with it.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+)
+
+const (
+	//The exit code of the sandbox when it couldn't be set up
+	sandboxInitFailure = 125
+	sandboxHostname    = "arrebol"
+)
+
+//The environment of the task script inside the sandbox
+var sandboxEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=/root",
+	"HOSTNAME=" + sandboxHostname,
+}
+
+//The devices of the host that are available inside the sandbox.
+//Only /dev/null is required, the others are bound if possible.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+const sandboxAvailable = true
+
+//It runs the task script inside the sandbox, following
+//the events that the task script executor writes to its stdout.
+func (r *SandboxRunner) Run(ctx context.Context) error {
+	cmd := exec.Command("/proc/self/exe", SandboxInitCommand, r.root, r.shell,
+		sandboxWorkDir+"/"+TaskScriptExecutorFileName, "-d", "-tsf="+sandboxWorkDir+"/"+taskScriptFileName)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		//the sandbox must not outlive the worker
+		Pdeathsig: syscall.SIGKILL,
+		Setpgid:   true,
+	}
+	return r.execute(ctx, cmd)
+}
+
+//It is the entry point of the sandbox, which must be called by the worker binary
+//when its first argument is SandboxInitCommand. The next ones are the root
+//filesystem and the command to be run inside it. It never returns.
+func SandboxInit() {
+	if len(os.Args) < 4 {
+		fmt.Fprintf(os.Stderr, "usage: %s %s ROOTFS COMMAND [ARGS...]\n", os.Args[0], SandboxInitCommand)
+		os.Exit(sandboxInitFailure)
+	}
+
+	if err := enterSandbox(os.Args[2]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error on setting up the sandbox: "+err.Error())
+		os.Exit(sandboxInitFailure)
+	}
+
+	cmd := exec.Command(os.Args[3], os.Args[4:]...)
+	cmd.Dir = sandboxWorkDir
+	cmd.Env = sandboxEnv
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	os.Exit(exitStatus(cmd.Run()))
+}
+
+//It makes root the root filesystem of the current mount namespace,
+//with its own /proc and /dev, and detaches the host's one.
+func enterSandbox(root string) error {
+	//the mounts below must not propagate to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making the mounts private: %w", err)
+	}
+	//pivot_root requires the new root to be a mount point
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding the root filesystem: %w", err)
+	}
+
+	proc, err := mountPoint(root, "/proc")
+	if err != nil {
+		return err
+	}
+	//some hosts (e.g containers) don't allow it, and most commands work without it
+	syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	if err := mountDevices(root); err != nil {
+		return err
+	}
+
+	if err := syscall.Sethostname([]byte(sandboxHostname)); err != nil {
+		return fmt.Errorf("setting the hostname: %w", err)
+	}
+
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	//the old root is stacked under the new one, and then detached
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivoting the root filesystem: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the host's root filesystem: %w", err)
+	}
+	return syscall.Chdir("/")
+}
+
+//It mounts a tmpfs on the /dev of root, binding the sandboxDevices of the host to it.
+func mountDevices(root string) error {
+	dev, err := mountPoint(root, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("mounting /dev: %w", err)
+	}
+
+	for _, device := range sandboxDevices {
+		target := filepath.Join(dev, device)
+		err := ioutil.WriteFile(target, nil, 0666)
+		if err == nil {
+			err = syscall.Mount("/dev/"+device, target, "", syscall.MS_BIND, "")
+		}
+		if err != nil && device == "null" {
+			return fmt.Errorf("binding /dev/null: %w", err)
+		}
+	}
+
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//It makes path, inside root, an empty directory to be mounted on.
+//Whatever the image has in its place is removed, since mounting on
+//a symbolic link would mount on its target instead.
+func mountPoint(root, path string) (string, error) {
+	target, err := utils.SecureJoin(root, path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := utils.RemoveAll(target); err != nil {
+			return "", err
+		}
+	}
+	return target, os.MkdirAll(target, 0755)
+}
+
+//It converts the result of a command into an exit code, as the shells do:
+//128 plus the signal number when the command has been killed by a signal.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return 127
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
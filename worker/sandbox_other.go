@@ -0,0 +1,20 @@
+// +build !linux
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const sandboxAvailable = false
+
+func (r *SandboxRunner) Run(ctx context.Context) error {
+	return errSandboxUnavailable
+}
+
+func SandboxInit() {
+	fmt.Fprintln(os.Stderr, errSandboxUnavailable)
+	os.Exit(125)
+}
@@ -0,0 +1,135 @@
+package worker
+
+//This module implements the execution of a task inside a rootless sandbox, for the
+//nodes that can't run a docker daemon. Each task gets a scratch directory, in which
+//a private root filesystem is unpacked, either from the layers of the task's
+//DockerImage (which are downloaded straight from its registry, see utils.PullImage)
+//or from a local rootfs tarball. The commands run inside fresh user, mount, PID,
+//network, UTS and IPC namespaces, with that root filesystem as their root (see
+//sandbox_linux.go), so they can't see the host's files, processes nor network.
+//The sandbox is only available on linux, and the task's limits are ignored.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+)
+
+const (
+	//The argument that makes the worker binary start a sandbox (see SandboxInit)
+	SandboxInitCommand = "sandbox-init"
+	//The directory of the task files inside the sandbox
+	sandboxWorkDir = "/arrebol"
+)
+
+var errSandboxUnavailable = errors.New("the sandbox runner is only available on linux")
+
+//The runner that executes each task inside a rootless sandbox
+type SandboxRunner struct {
+	//The rootfs tarball (which may be gzipped) unpacked for every task.
+	//Empty means the root filesystem comes from the task's DockerImage.
+	Rootfs string
+	//The directory in which the layers of the images are kept.
+	//Empty means arrebol-images in the system's temporary directory.
+	CacheDir string
+	//The root filesystem of the task, inside its scratch directory
+	root string
+	//The shell available inside the sandbox, which runs the task script
+	shell string
+	ProcessRunner
+}
+
+//It creates the task's scratch directory, unpacks the root filesystem into it
+//and writes the task script executor and the task's commands to its /arrebol.
+func (r *SandboxRunner) Prepare(ctx context.Context, task *Task) error {
+	defer r.markReady()
+	dir, err := ioutil.TempDir(r.BaseDir, fmt.Sprintf("arrebol-sandbox-%v-", task.ID))
+
+	if err != nil {
+		return err
+	}
+	//from now on, the directory must be removed at the end of the execution
+	r.dir = dir
+	r.commands = len(task.Commands)
+	r.root = filepath.Join(dir, "rootfs")
+	r.workDir = filepath.Join(r.root, sandboxWorkDir)
+
+	if err := os.Mkdir(r.root, 0755); err != nil {
+		return err
+	}
+
+	layers, err := r.layers(ctx, task)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Unpacking the root filesystem of the task [%v]", task.ID)
+	if err := utils.UnpackLayers(layers, r.root); err != nil {
+		return err
+	}
+
+	if r.shell, err = r.detectShell(); err != nil {
+		return err
+	}
+
+	if err := r.makeWorkDir(); err != nil {
+		return err
+	}
+
+	executor, err := ioutil.ReadFile(filepath.Join(os.Getenv("BIN_PATH"), TaskScriptExecutorFileName))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.workDir, TaskScriptExecutorFileName), executor, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.workDir, taskScriptFileName), taskScript(task), 0644)
+}
+
+//It returns the files to be unpacked as the task's root filesystem,
+//from the lowest to the topmost one.
+func (r *SandboxRunner) layers(ctx context.Context, task *Task) ([]string, error) {
+	if r.Rootfs != "" {
+		return []string{r.Rootfs}, nil
+	}
+
+	if task.DockerImage == "" {
+		return nil, errors.New("the task has no image to run on")
+	}
+
+	cacheDir := r.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "arrebol-images")
+	}
+
+	log.Println("Pulling image: " + task.DockerImage)
+	return utils.PullImage(ctx, task.DockerImage, cacheDir)
+}
+
+//It finds the first of utils.Shells that exists in the root filesystem.
+//It returns an error wrapping utils.ErrNoShell if there is none of them.
+func (r *SandboxRunner) detectShell() (string, error) {
+	return utils.FindShell(func(shell string) (bool, error) {
+		path, err := utils.SecureJoin(r.root, shell)
+		if err != nil {
+			return false, nil
+		}
+		_, err = os.Lstat(path)
+		return err == nil, nil
+	})
+}
+
+//It creates an empty /arrebol in the root filesystem, replacing whatever the
+//image has in its place (e.g a symbolic link, which would lead out of it).
+func (r *SandboxRunner) makeWorkDir() error {
+	if err := utils.RemoveAll(r.workDir); err != nil {
+		return err
+	}
+	return os.Mkdir(r.workDir, 0755)
+}
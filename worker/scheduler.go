@@ -0,0 +1,234 @@
+package worker
+
+//This module implements the worker's scheduling loop. Instead of executing
+//one task at a time, the worker splits the resources it advertises to the
+//server (Vcpu and Ram) into slots (see Worker.Slots). A new task is only
+//asked for while there is a free slot, and each task is executed in its own
+//goroutine, through its own TaskRunner, reporting its progress independently.
+//While the queue is empty, the worker waits longer and longer between two
+//attempts of getting a task (up to MaxGetTaskInterval), unless the server tells
+//it when to try again.
+//When the worker is shutting down, the loop stops asking for tasks and the
+//running ones are drained: they may finish up to a grace period, then they are cancelled.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ufcg-lsd/arrebol-pb-worker/apierrors"
+)
+
+const (
+	//Period between two attempts of getting a task when the last one has failed.
+	//It doubles at each failed attempt, up to MaxGetTaskInterval.
+	GetTaskInterval    = 3 * time.Second
+	MaxGetTaskInterval = 60 * time.Second
+	//How long before the token expires the worker joins the server again
+	TokenRefreshMargin = 1 * time.Minute
+)
+
+type Scheduler struct {
+	worker         *Worker
+	serverEndpoint string
+	//Each running task holds one position of this channel,
+	//so sending to it blocks while all the slots are busy.
+	slots   chan struct{}
+	running sync.WaitGroup
+	idle    backoff
+	//The context in which the tasks are executed. Cancelling it
+	//interrupts all the running tasks.
+	tasksCtx    context.Context
+	cancelTasks context.CancelFunc
+}
+
+func NewScheduler(w *Worker, serverEndpoint string) *Scheduler {
+	tasksCtx, cancelTasks := context.WithCancel(context.Background())
+	return &Scheduler{
+		worker:         w,
+		serverEndpoint: serverEndpoint,
+		slots:          make(chan struct{}, w.Slots()),
+		idle:           backoff{min: GetTaskInterval, max: MaxGetTaskInterval},
+		tasksCtx:       tasksCtx,
+		cancelTasks:    cancelTasks,
+	}
+}
+
+//It runs the scheduling loop: wait for a free slot, get a task from
+//the server and execute it in background. It returns as soon as ctx is done,
+//without waiting for the running tasks (see Drain). A task got once ctx
+//is done is not started, but reported to the server as cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	log.Printf("Starting scheduler with %d slot(s)", cap(s.slots))
+	go s.keepTokenFresh(ctx)
+	for {
+		if ctx.Err() != nil || !s.acquire(ctx) {
+			break
+		}
+		task, err := s.worker.GetTask(ctx, s.serverEndpoint)
+
+		if err != nil {
+			s.release()
+			if errors.Is(err, apierrors.ErrSignature) && task != nil {
+				log.Printf("Rejecting task [%d]: %s", task.ID, err.Error())
+				if err := s.worker.RejectTask(task, s.serverEndpoint); err != nil {
+					log.Println("Error on rejecting the task: " + err.Error())
+				}
+			}
+
+			wait := s.idle.next()
+			if retryAfter := apierrors.RetryAfter(err); retryAfter > 0 {
+				wait = retryAfter
+			}
+
+			if errors.Is(err, ErrNoTaskAvailable) {
+				log.Printf("No task available; trying again in %s", wait)
+			} else {
+				log.Printf("Error on getting a task: %s; trying again in %s", err.Error(), wait)
+			}
+
+			if !sleep(ctx, wait) {
+				break
+			}
+
+			//an unknown worker or queue (NotFound) is also solved by joining again
+			if errors.Is(err, apierrors.ErrAuth) || errors.Is(err, apierrors.ErrNotFound) {
+				if err := s.worker.Join(s.serverEndpoint); err != nil {
+					log.Println("Error on joining the server: " + err.Error())
+				}
+			}
+			continue
+		}
+		s.idle.reset()
+
+		if ctx.Err() != nil {
+			//the worker has started shutting down while the task was on its way
+			s.release()
+			s.giveUp(task)
+			break
+		}
+
+		s.running.Add(1)
+		go func(task *Task) {
+			defer s.running.Done()
+			defer s.release()
+			s.worker.ExecTask(s.tasksCtx, task, s.serverEndpoint)
+		}(task)
+	}
+	log.Println("The scheduler has stopped getting new tasks")
+}
+
+//It tells the server that the task, which has been got but not started,
+//has been cancelled, since the worker is shutting down.
+func (s *Scheduler) giveUp(task *Task) {
+	log.Printf("The worker is shutting down; cancelling the task [%d] without starting it", task.ID)
+	task.State = TaskCancelled
+	if _, err := s.worker.sendTaskReport(context.Background(), task, s.serverEndpoint); err != nil {
+		log.Println("Error on reporting task: " + err.Error())
+	}
+}
+
+//It joins the server again shortly before the worker's token expires, so that
+//neither getting tasks nor reporting them fails because of an expired token.
+//It returns as soon as ctx is done.
+func (s *Scheduler) keepTokenFresh(ctx context.Context) {
+	retry := backoff{min: GetTaskInterval, max: MaxGetTaskInterval}
+	for {
+		expiresAt := s.worker.TokenExpiresAt()
+		if expiresAt.IsZero() {
+			return
+		}
+
+		if !sleep(ctx, refreshDelay(expiresAt, TokenRefreshMargin)) {
+			return
+		}
+
+		if !s.worker.TokenExpiresAt().Equal(expiresAt) {
+			//the worker has already joined again meanwhile
+			continue
+		}
+
+		log.Println("The token is about to expire; joining the server again")
+		if err := s.worker.Join(s.serverEndpoint); err != nil {
+			wait := retry.next()
+			log.Printf("Error on joining the server: %s; trying again in %s", err.Error(), wait)
+			if !sleep(ctx, wait) {
+				return
+			}
+			continue
+		}
+		retry.reset()
+	}
+}
+
+//It waits for the running tasks to finish. The ones that are still
+//running when the grace period expires are cancelled. It returns
+//once every task has sent its final report.
+func (s *Scheduler) Drain(gracePeriod time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	log.Printf("Waiting up to %s for %d running task(s)", gracePeriod, len(s.slots))
+	select {
+	case <-done:
+	case <-time.After(gracePeriod):
+		log.Println("The grace period has expired; cancelling the running tasks")
+		s.cancelTasks()
+		<-done
+	}
+	s.cancelTasks()
+}
+
+//It waits for a free slot and takes it.
+//It returns false if ctx is done before that.
+func (s *Scheduler) acquire(ctx context.Context) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Scheduler) release() {
+	<-s.slots
+}
+
+//An exponential backoff: each call to next returns twice
+//the previous interval, starting from min and up to max.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.current < b.min {
+		b.current = b.min
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+//It sleeps for the given duration.
+//It returns false if ctx is done before that.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
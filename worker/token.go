@@ -0,0 +1,164 @@
+package worker
+
+//This module implements the validation of the token that the server assigns
+//to the worker when it joins (see Join). The token is a JWT signed by the server
+//with one of TokenMethods, and it is only accepted if:
+//1. its signature matches the server's public key
+//2. it has been issued by TokenIssuer, to TokenAudience
+//3. it has not expired (exp), and it is already valid (nbf, iat), give or take TokenLeeway
+//4. its WorkerId claim is the worker's ID, and it carries the worker's QueueId
+//Since the token expires, the worker joins the server again a while
+//before that happens (see Scheduler.keepTokenFresh).
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+)
+
+const (
+	//The expected issuer (iss) and audience (aud) of the token, and the
+	//clock skew (in seconds) tolerated on checking its timestamps
+	TokenIssuerKey   = "TOKEN_ISSUER"
+	TokenAudienceKey = "TOKEN_AUDIENCE"
+	TokenLeewayKey   = "TOKEN_LEEWAY"
+)
+
+var (
+	TokenIssuer   = "arrebol-server"
+	TokenAudience = "arrebol-worker"
+	TokenLeeway   = 30 * time.Second
+	//The algorithms the server may sign the token with. Any other one,
+	//including "none", is refused.
+	TokenMethods = []string{"RS256", "ES256"}
+
+	//The error wrapped by every token validation error
+	ErrInvalidToken = errors.New("invalid token")
+
+	//for test purpose
+	ParseToken func(tokenStr string, workerId string) (map[string]interface{}, error) = parseToken
+	now                                                                               = time.Now
+)
+
+//It parses the token assigned to the worker workerId and validates it.
+//It returns the token claims, or an error wrapping ErrInvalidToken
+//that tells why the token has been refused.
+func parseToken(tokenStr string, workerId string) (map[string]interface{}, error) {
+	parser := jwt.Parser{ValidMethods: TokenMethods, SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		return utils.GetPublicKey(ServerKeyName)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("%w: unexpected claims", ErrInvalidToken)
+	}
+
+	if err := validateClaims(claims, workerId); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+
+	return claims, nil
+}
+
+//It checks the claims that the worker requires from the token.
+func validateClaims(claims jwt.MapClaims, workerId string) error {
+	currentTime := now()
+
+	expiresAt, err := timeClaim(claims, "exp", true)
+	if err != nil {
+		return err
+	}
+	if currentTime.After(expiresAt.Add(TokenLeeway)) {
+		return fmt.Errorf("the token has expired at %s", expiresAt)
+	}
+
+	for _, name := range []string{"nbf", "iat"} {
+		validFrom, err := timeClaim(claims, name, false)
+		if err != nil {
+			return err
+		}
+		if currentTime.Add(TokenLeeway).Before(validFrom) {
+			return fmt.Errorf("the token is not valid before %s (%s)", validFrom, name)
+		}
+	}
+
+	if issuer, _ := claims["iss"].(string); issuer != TokenIssuer {
+		return fmt.Errorf("unexpected issuer [%s]; expected [%s]", issuer, TokenIssuer)
+	}
+
+	if !hasAudience(claims, TokenAudience) {
+		return fmt.Errorf("the token audience doesn't include [%s]", TokenAudience)
+	}
+
+	if tokenWorkerId, _ := claims["WorkerId"].(string); tokenWorkerId != workerId {
+		return fmt.Errorf("the token has been issued to worker [%s], not to [%s]", tokenWorkerId, workerId)
+	}
+
+	if _, ok := claims["QueueId"].(float64); !ok {
+		return errors.New("the QueueId claim is missing")
+	}
+
+	return nil
+}
+
+//It checks if the aud claim, which is either a string or an array of strings, includes audience.
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//It reads a NumericDate claim (seconds since epoch).
+//It returns the zero time if the claim is missing and not required.
+func timeClaim(claims jwt.MapClaims, name string, required bool) (time.Time, error) {
+	value, ok := claims[name]
+	if !ok {
+		if required {
+			return time.Time{}, fmt.Errorf("the %s claim is missing", name)
+		}
+		return time.Time{}, nil
+	}
+
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("the %s claim is not a timestamp", name)
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
+
+//It returns when the worker's token expires, or the zero time if the worker has no token.
+func (w *Worker) TokenExpiresAt() time.Time {
+	w.credentialsLock.RLock()
+	defer w.credentialsLock.RUnlock()
+	return w.tokenExpiresAt
+}
+
+//It returns how long the worker may wait before joining the server again,
+//so that it happens margin before the token expires. If the token has less
+//than twice the margin left, it happens halfway through the remaining time.
+func refreshDelay(expiresAt time.Time, margin time.Duration) time.Duration {
+	remaining := expiresAt.Sub(now())
+	if remaining <= 0 {
+		return 0
+	}
+	if margin > remaining/2 {
+		margin = remaining / 2
+	}
+	return remaining - margin
+}
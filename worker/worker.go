@@ -1,18 +1,22 @@
 package worker
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/docker/docker/client"
 	uuid "github.com/satori/go.uuid"
+	"github.com/ufcg-lsd/arrebol-pb-worker/apierrors"
 	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
 )
 
@@ -39,10 +43,35 @@ type Worker struct {
 	//The queue from which the worker must ask for tasks
 	QueueID uint
 
+	//The maximum number of processes each task may run (optional).
+	//When it is not set, DefaultPidsLimit is used.
+	PidsLimit int64 `json:",omitempty"`
+
+	//The backend that executes the tasks (optional): docker (default),
+	//process or sandbox (see runner.go).
+	Runner string `json:",omitempty"`
+
+	//The rootfs tarball on which the sandbox runner runs every task (optional).
+	//When it is not set, the root filesystem comes from the task's DockerImage.
+	Rootfs string `json:",omitempty"`
+
 	//The Token that the server has been assigned to the worker
 	//so it is able to authenticate in next requests
 	Token string `json:"-"`
+
+	//When the Token expires (see token.go)
+	tokenExpiresAt time.Time
+
+	//The Token and the QueueID are refreshed by the scheduling loop (see Join)
+	//while the running tasks read them to report their progress, so every access
+	//after the worker has started must go through this lock.
+	credentialsLock sync.RWMutex
+
+	//The docker client shared by the tasks of the docker runner (see dockerClient)
+	dockerMutex sync.Mutex
+	docker      *client.Client
 }
+
 type Base struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
@@ -52,6 +81,16 @@ type Base struct {
 
 const (
 	WorkerNodeAddressKey = "WORKER_NODE_ADDRESS"
+	//The minimum amount of Ram (MegaBytes) that a slot must have.
+	MinRamPerSlot = 256
+	//The minimum amount of Ram (MegaBytes) of a task, below which docker refuses to create its container
+	MinTaskRam = 6
+	//The maximum number of processes of a task, if the worker conf doesn't set one
+	DefaultPidsLimit = 1024
+	//The name of the server's public key, which verifies the tokens and the tasks
+	ServerKeyName = "server"
+	//How old the signature of a task may be when it gets to the worker
+	MaxTaskSignatureAge = 5 * time.Minute
 )
 
 type TaskState uint8
@@ -61,36 +100,84 @@ const (
 	TaskRunning
 	TaskFinished
 	TaskFailed
+	TaskCancelled
+	TaskTimedOut
+	//The worker has refused to execute the task, whose signature is missing or invalid
+	TaskRejected
+)
+
+var (
+	//There is no task available in the worker's queue
+	ErrNoTaskAvailable = errors.New("There is no task available in the queue")
 )
 
 var (
-	//for test purpose
-	ParseToken func(tokenStr string) (map[string]interface{}, error) = parseToken
+	//The interval between the reports of a task that doesn't set its ReportInterval
+	DefaultReportInterval = 30 * time.Second
+	//The reports are never sent more often than MinReportInterval,
+	//and always at least once per MaxReportInterval
+	MinReportInterval = 1 * time.Second
+	MaxReportInterval = 5 * time.Minute
 )
 
 //This struct represents a task, the executable piece of the system.
 type Task struct {
 	// Sequence of unix command to be execute by the worker
 	Commands []*Command
-	// Period (in seconds) between report status from the worker to the server
+	// Period (in seconds) between report status from the worker to the server,
+	// besides the reports of each command start and end (see reportInterval)
 	ReportInterval int64
 	State          TaskState
 	// Indication of task completion progress, ranging from 0 to 100
 	Progress int
 	// Docker image used to execute the task (e.g library/ubuntu:tag).
+	// Since the commands are shell commands, the image must have one of
+	// utils.Shells; otherwise (e.g a distroless image) the task fails.
 	DockerImage string
 	ID          uint
+	// Maximum time (in seconds) the whole task may run (optional).
+	// Zero means no timeout.
+	Timeout int64 `json:",omitempty"`
+	// Vcpu required by the task (optional). When it is not set or it is more
+	// than the worker's Vcpu share of one slot, the task gets that share.
+	Vcpu float32 `json:",omitempty"`
+	// Ram (MegaBytes) required by the task (optional). When it is not set or it is
+	// more than the worker's Ram share of one slot, the task gets that share.
+	Ram uint32 `json:",omitempty"`
+}
+
+//The resources that the task's container is allowed to use
+type TaskLimits struct {
+	Vcpu float32
+	//MegaBytes
+	Ram       uint32
+	PidsLimit int64
 }
 
 type Command struct {
-	ID         uint
-	TaskID     uint         `json:"TaskID"`
-	ExitCode   int8         `json:"ExitCode"`
+	ID       uint
+	TaskID   uint `json:"TaskID"`
+	ExitCode int  `json:"ExitCode"`
+	// The signal by which the worker has killed the command (e.g 9 for SIGKILL) when it has
+	// interrupted the task (on a timeout or a cancellation), or zero. A command killed by any
+	// other signal only has the exit code given by the shell (128 + signal).
+	Signal     int          `json:"Signal,omitempty"`
 	RawCommand string       `json:"RawCommand"`
 	State      CommandState `json:"State"`
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
 	DeletedAt  *time.Time `sql:"index"`
+	// Maximum time (in seconds) the command may run (optional).
+	// Zero means no timeout.
+	Timeout int64 `json:"Timeout,omitempty"`
+	// When the command has started and finished running (unix seconds precision).
+	// They are nil while the command hasn't reached that point.
+	StartedAt  *time.Time `json:"StartedAt,omitempty"`
+	FinishedAt *time.Time `json:"FinishedAt,omitempty"`
+	// The end of the command's output (see MaxCommandOutputSize).
+	// They are only sent in the task's final report.
+	Stdout string `json:"Stdout,omitempty"`
+	Stderr string `json:"Stderr,omitempty"`
 }
 
 type CommandState uint8
@@ -100,105 +187,314 @@ const (
 	CmdRunning
 	CmdFinished
 	CmdFailed
+	CmdTimedOut
 )
 
 func (cs CommandState) String() string {
-	return [...]string{"NotStarted", "Running", "Finished", "Failed"}[cs]
+	return [...]string{"NotStarted", "Running", "Finished", "Failed", "TimedOut"}[cs]
 }
 
 func (ts TaskState) String() string {
-	return [...]string{"TaskPending ", "TaskRunning", "TaskFinished", "TaskFailed"}[ts]
+	return [...]string{"TaskPending ", "TaskRunning", "TaskFinished", "TaskFailed", "TaskCancelled", "TaskTimedOut", "TaskRejected"}[ts]
+}
+
+//It subscribes the worker to the server, which assigns it a token and a queue.
+//When the server refuses the worker's key pair and an unfinished rotation has left
+//a new one, the new one is tried as well (see joinWithPendingKeys).
+//It returns nil on success, or an *apierrors.Error otherwise.
+func (w *Worker) Join(serverEndpoint string) error {
+	err := w.join(serverEndpoint)
+
+	if (errors.Is(err, apierrors.ErrAuth) || errors.Is(err, apierrors.ErrConflict)) && utils.HasPendingAccessKeys(w.ID.String()) {
+		return w.joinWithPendingKeys(serverEndpoint, err)
+	}
+	return err
+}
+
+//It joins the server with the key pair left by an unfinished rotation (see RotateKeys),
+//which the server may have accepted without the worker knowing it. The pair becomes
+//the current one if the server accepts it; otherwise, the current pair is restored and
+//the error of the current pair, joinErr, is returned.
+func (w *Worker) joinWithPendingKeys(serverEndpoint string, joinErr error) error {
+	id := w.ID.String()
+	log.Println("The server has refused the key pair; trying the one of an unfinished rotation")
+
+	if err := utils.SwapPendingAccessKeys(id); err != nil {
+		log.Println("Error on swapping the key pairs: " + err.Error())
+		return joinErr
+	}
+
+	if err := w.join(serverEndpoint); err != nil {
+		if err := utils.SwapPendingAccessKeys(id); err != nil {
+			log.Println("Error on restoring the key pair: " + err.Error())
+		}
+		return joinErr
+	}
+
+	log.Println("The server had accepted the key pair of the unfinished rotation")
+	if err := utils.DiscardPendingAccessKeys(id); err != nil {
+		log.Println("Error on removing the previous key pair: " + err.Error())
+	}
+	return nil
 }
 
-func (w *Worker) Join(serverEndpoint string) {
+func (w *Worker) join(serverEndpoint string) error {
 	headers := http.Header{}
 
-	publicKey, err := utils.GetBase64PubKey(w.ID.String())
+	publicKey, err := utils.GetPublicKeyHeader(w.ID.String())
 
 	if err != nil {
-		log.Fatal("Error on retrieving key as base64. " + err.Error())
+		return apierrors.New(apierrors.Unknown, "join", fmt.Errorf("retrieving the public key: %w", err))
 	}
 
 	headers.Set(PUBLIC_KEY, publicKey)
-	httpResponse, err := utils.Post(w.ID.String(), w, headers, serverEndpoint+"/workers")
+	httpResponse, err := utils.PostIdempotent(context.Background(), w.ID.String(), w, headers, serverEndpoint+"/workers")
 
 	if err != nil {
-		log.Fatal("Error on joining the server: " + err.Error())
+		return apierrors.Wrap("join", err)
 	}
 
-	HandleJoinResponse(httpResponse, w)
+	return HandleJoinResponse(httpResponse, w)
 }
 
-func HandleJoinResponse(response *utils.HttpResponse, w *Worker) {
+//It sets the worker's token and queue id from the join response.
+//It returns nil on success, or an *apierrors.Error otherwise.
+func HandleJoinResponse(response *utils.HttpResponse, w *Worker) error {
+	const op = "join"
+	if err := apierrors.FromResponse(op, response.StatusCode, response.Headers, response.Body); err != nil {
+		return err
+	}
+
 	if response.StatusCode != 201 {
-		log.Fatal("The work could not be subscribed. Status Code: " + strconv.Itoa(response.StatusCode))
+		return &apierrors.Error{Op: op, StatusCode: response.StatusCode, Body: response.Body,
+			Err: errors.New("the worker could not be subscribed")}
 	}
 
 	var parsedBody map[string]string
 	err := json.Unmarshal(response.Body, &parsedBody)
 
 	if err != nil {
-		log.Fatal("Unable to parse the response body")
+		return &apierrors.Error{Kind: apierrors.Decode, Op: op, StatusCode: response.StatusCode, Body: response.Body, Err: err}
 	}
 
 	token, ok := parsedBody["arrebol-worker-token"]
 
 	if !ok {
-		log.Fatal("The token is not in the response body")
+		return apierrors.New(apierrors.Decode, op, errors.New("the token is not in the response body"))
 	}
 
-	parsedToken, err := ParseToken(token)
+	parsedToken, err := ParseToken(token, w.ID.String())
 
 	if err != nil {
-		log.Fatal(err)
+		return apierrors.New(apierrors.Auth, op, err)
 	}
 
-	queueId, ok := parsedToken["QueueId"]
+	queueId, ok := parsedToken["QueueId"].(float64)
 
 	if !ok {
-		log.Fatal("The queue_id is not in the response body")
+		return apierrors.New(apierrors.Decode, op, errors.New("the QueueId is not in the token"))
 	}
 
+	expiresAt, _ := timeClaim(parsedToken, "exp", false)
+
+	w.credentialsLock.Lock()
+	defer w.credentialsLock.Unlock()
 	w.Token = token
-	w.QueueID = uint(queueId.(float64))
+	w.QueueID = uint(queueId)
+	w.tokenExpiresAt = expiresAt
+	return nil
+}
+
+//It deregisters the worker from the server, so no more tasks are dispatched to it.
+//It returns nil on success, or an *apierrors.Error otherwise.
+func (w *Worker) Leave(serverEndpoint string) error {
+	token, _ := w.credentials()
+	headers := http.Header{}
+	headers.Set("arrebol-worker-token", token)
+
+	httpResponse, err := utils.Delete(context.Background(), w.ID.String(), serverEndpoint+"/workers/"+w.ID.String(), headers)
+
+	if err != nil {
+		return err
+	}
+
+	return apierrors.FromResponse("leave", httpResponse.StatusCode, httpResponse.Headers, httpResponse.Body)
+}
+
+//The body of the key rotation request
+type keyRotation struct {
+	//The algorithm of the new key
+	Algorithm utils.Algorithm
+	//The new public key, as base64 encoded PEM
+	PublicKey string
+}
+
+//It replaces the worker's key pair. The new public key is sent to the server
+//in a request signed with the current private key, so that the server can
+//trust it; the new pair is only used once the server has accepted it.
+//Since the request is authorized by the worker's token as well, a worker
+//that has no token yet (e.g in the rotate-keys command) joins the server first.
+//The request is sent once: if its outcome is unclear (e.g the response has been
+//lost or the server has failed), the server may trust the new pair already, so it
+//is kept as pending, instead of being discarded, and reused by the next rotation.
+//Joining settles which pair the server trusts (see Join), so a worker with a pending
+//pair joins the server before the rotation as well.
+//It returns nil on success, or an *apierrors.Error otherwise, in which case the
+//current key pair is kept.
+func (w *Worker) RotateKeys(serverEndpoint string) error {
+	return apierrors.Wrap("rotate keys", w.rotateKeys(serverEndpoint))
 }
 
-func (w *Worker) GetTask(serverEndPoint string) (*Task, error) {
+//It rotates the key pair as RotateKeys does, but its errors may be of any type.
+func (w *Worker) rotateKeys(serverEndpoint string) error {
+	id := w.ID.String()
+
+	if token, _ := w.credentials(); token == "" || utils.HasPendingAccessKeys(id) {
+		if err := w.Join(serverEndpoint); err != nil {
+			return err
+		}
+	}
+
+	newPublicKey, err := utils.PendingAccessKeys(id)
+
+	if err != nil {
+		return fmt.Errorf("generating the new key pair: %w", err)
+	}
+
+	token, _ := w.credentials()
+	headers := http.Header{}
+	headers.Set("arrebol-worker-token", token)
+	body := keyRotation{Algorithm: utils.KeyAlgorithm, PublicKey: base64.StdEncoding.EncodeToString(newPublicKey)}
+
+	httpResponse, err := utils.PostOnce(context.Background(), id, body, headers, serverEndpoint+"/workers/"+id+"/keys")
+
+	if err == nil {
+		err = apierrors.FromResponse("rotate keys", httpResponse.StatusCode, httpResponse.Headers, httpResponse.Body)
+	}
+
+	if err != nil {
+		//only a 4xx tells that the server hasn't accepted the new pair
+		var apiErr *apierrors.Error
+		if errors.As(err, &apiErr) && apiErr.Kind != apierrors.Transport && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+			utils.DiscardPendingAccessKeys(id)
+		} else {
+			log.Println("The new key pair is kept, since the server may have accepted it")
+		}
+		return err
+	}
+
+	return utils.CommitPendingAccessKeys(id)
+}
+
+//It returns the token and the queue id currently assigned to the worker.
+func (w *Worker) credentials() (string, uint) {
+	w.credentialsLock.RLock()
+	defer w.credentialsLock.RUnlock()
+	return w.Token, w.QueueID
+}
+
+//It returns how many tasks the worker is able to run at the same time.
+//Each slot takes one Vcpu and, at least, MinRamPerSlot MegaBytes of Ram,
+//so the capacity is bounded by the scarcer of these resources.
+//The worker always has, at least, one slot.
+func (w *Worker) Slots() int {
+	slots := int(w.Vcpu)
+	if ramSlots := int(w.Ram / MinRamPerSlot); ramSlots < slots {
+		slots = ramSlots
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	return slots
+}
+
+//It asks the server for a task of the worker's queue.
+//It returns:
+//1. the task and nil, if there was one available
+//2. nil and an *apierrors.Error of the Empty kind, which wraps ErrNoTaskAvailable, if the queue is empty
+//(the server answers 204, or 200 with an empty or null body)
+//3. nil and an *apierrors.Error of the Auth kind, if the worker must join the server (again)
+//4. the task and an *apierrors.Error of the Signature kind, if the server's signature over
+//the task is missing or invalid. In this case, the task must not be executed; it is
+//only returned so it can be rejected (see RejectTask).
+//5. nil and an *apierrors.Error of another kind (e.g NotFound, Transport, Server, Decode) otherwise
+//When the server tells when to try again (Retry-After), it is kept in the error's RetryAfter.
+func (w *Worker) GetTask(ctx context.Context, serverEndPoint string) (*Task, error) {
+	const op = "get task"
 	log.Println("Starting GetTask routine")
 
-	if w.QueueID == 0 {
-		return nil, errors.New("The QueueId must be set before getting a task")
+	token, queueID := w.credentials()
+
+	if queueID == 0 {
+		return nil, apierrors.New(apierrors.Auth, op, errors.New("the QueueId must be set before getting a task"))
 	}
 
-	url := serverEndPoint + "/workers/" + w.ID.String() + "/queues/" + fmt.Sprint(w.QueueID) + "/tasks"
+	url := serverEndPoint + "/workers/" + w.ID.String() + "/queues/" + fmt.Sprint(queueID) + "/tasks"
 
 	headers := http.Header{}
-	headers.Set("arrebol-worker-token", w.Token)
+	headers.Set("arrebol-worker-token", token)
 
-	httpResp, err := utils.Get(w.ID.String(), url, headers)
+	httpResp, err := utils.Get(ctx, w.ID.String(), url, headers)
 
 	if err != nil {
-		return nil, errors.New("Error on GET request: " + err.Error())
+		return nil, err
+	}
+
+	respBody := bytes.TrimSpace(httpResp.Body)
+
+	//a 404 means that the worker or its queue is unknown to the server, which is not the same as an empty queue
+	if httpResp.StatusCode == http.StatusNoContent ||
+		(httpResp.StatusCode == http.StatusOK && (len(respBody) == 0 || bytes.Equal(respBody, []byte("null")))) {
+		return nil, &apierrors.Error{
+			Kind:       apierrors.Empty,
+			Op:         op,
+			StatusCode: httpResp.StatusCode,
+			RetryAfter: apierrors.ParseRetryAfter(httpResp.Headers),
+			Err:        ErrNoTaskAvailable,
+		}
 	}
 
-	respBody := httpResp.Body
+	if err := apierrors.FromResponse(op, httpResp.StatusCode, httpResp.Headers, httpResp.Body); err != nil {
+		return nil, err
+	}
 
 	var task Task
 	err = json.Unmarshal(respBody, &task)
 
 	if err != nil {
-		return nil, errors.New("Error on unmarshalling the task: " + err.Error())
+		return nil, &apierrors.Error{Kind: apierrors.Decode, Op: op, StatusCode: httpResp.StatusCode, Body: httpResp.Body, Err: err}
+	}
+
+	if err := verifyTaskSignature(httpResp); err != nil {
+		return &task, &apierrors.Error{Kind: apierrors.Signature, Op: op, StatusCode: httpResp.StatusCode, Err: err}
 	}
 
-	// task.ReportInterval = 1
-	// task.DockerImage = "docker.io/ubuntu:latest"
 	return &task, nil
 }
 
-func ParseWorkerConfiguration(reader io.Reader) Worker {
+//It checks the server's signature over the response that has carried a task,
+//which must have been signed for the worker's request.
+func verifyTaskSignature(httpResp *utils.HttpResponse) error {
+	serverKey, err := utils.GetPublicKey(ServerKeyName)
+
+	if err != nil {
+		return errors.New("Error on loading the server key. " + err.Error())
+	}
+
+	return utils.VerifyResponse(httpResp.Headers, httpResp.StatusCode, httpResp.Body, httpResp.Request, serverKey, MaxTaskSignatureAge)
+}
+
+//It tells the server that the worker has refused to execute the task.
+//Nothing but the task ID is sent back, since the rest of it can't be trusted.
+func (w *Worker) RejectTask(task *Task, serverEndPoint string) error {
+	_, err := w.sendTaskReport(context.Background(), &Task{ID: task.ID, State: TaskRejected}, serverEndPoint)
+	return err
+}
+
+func ParseWorkerConfiguration(reader io.Reader) *Worker {
 	decoder := json.NewDecoder(reader)
-	configuration := Worker{}
-	err := decoder.Decode(&configuration)
+	configuration := &Worker{}
+	err := decoder.Decode(configuration)
 	if err != nil {
 		log.Println("Error on decoding configuration file", err.Error())
 	}
@@ -206,68 +502,345 @@ func ParseWorkerConfiguration(reader io.Reader) Worker {
 	return configuration
 }
 
-func (w *Worker) ExecTask(task *Task, serverEndPoint string) {
-	address := os.Getenv(WorkerNodeAddressKey)
-	client := utils.NewDockerClient(address)
-	taskExecutor := &TaskExecutor{Cli: *client}
+//It checks whether the resources in the worker's conf are enough to run a task.
+//It returns an error if there is no Vcpu or if the Ram share of a slot is less than MinTaskRam.
+func (w *Worker) CheckResources() error {
+	if w.Vcpu <= 0 {
+		return fmt.Errorf("the worker must have some vcpu, got %v", w.Vcpu)
+	}
+	if ram := w.Ram / uint32(w.Slots()); ram < MinTaskRam {
+		return fmt.Errorf("the worker must have, at least, %d MegaBytes of ram per slot, got %d", MinTaskRam, ram)
+	}
+	return nil
+}
+
+//It returns the resources that the task is allowed to use.
+//Since each task takes one slot (see Scheduler), it gets the share of the
+//worker's resources that belongs to one slot. The task's own requirements
+//are honored as long as they fit in that share, so that a task may
+//ask for less, but never for more, than its slot.
+func (w *Worker) TaskLimits(task *Task) TaskLimits {
+	slots := w.Slots()
+	limits := TaskLimits{
+		Vcpu:      w.Vcpu / float32(slots),
+		Ram:       w.Ram / uint32(slots),
+		PidsLimit: w.PidsLimit,
+	}
+
+	if task.Vcpu > 0 && task.Vcpu < limits.Vcpu {
+		limits.Vcpu = task.Vcpu
+	}
+
+	if task.Ram > 0 && task.Ram < limits.Ram {
+		limits.Ram = task.Ram
+		if limits.Ram < MinTaskRam {
+			limits.Ram = MinTaskRam
+		}
+	}
+
+	if limits.PidsLimit <= 0 {
+		limits.PidsLimit = DefaultPidsLimit
+	}
+
+	return limits
+}
+
+//It receives the reports of a task's progress during its execution (see RunTask)
+type TaskReporter interface {
+	//It reports the task's current state. It returns true if the task must be
+	//cancelled, or an error if the report couldn't be delivered.
+	//It gives up as soon as ctx is done.
+	Report(ctx context.Context, task *Task) (bool, error)
+}
+
+//The reporter that sends the reports to the server
+type serverReporter struct {
+	worker         *Worker
+	serverEndPoint string
+}
+
+func (r *serverReporter) Report(ctx context.Context, task *Task) (bool, error) {
+	return r.worker.sendTaskReport(ctx, task, r.serverEndPoint)
+}
+
+//It executes the task and reports its progress to the server until the execution is over.
+//The execution is cancelled when ctx is done or when the server answers a report
+//asking for it; either way, the final report carries the TaskCancelled state.
+//When the task's Timeout or the Timeout of one of its commands expires, the execution
+//is interrupted as well and the final report carries the TaskTimedOut state.
+func (w *Worker) ExecTask(ctx context.Context, task *Task, serverEndPoint string) {
+	w.RunTask(ctx, task, &serverReporter{worker: w, serverEndPoint: serverEndPoint})
+}
+
+//It executes the task as ExecTask does, but sends the reports to the reporter.
+//It returns once the final report has been sent, leaving the final state in task.State.
+func (w *Worker) RunTask(ctx context.Context, task *Task, reporter TaskReporter) {
+	runner, err := w.newRunner(task)
+
+	if err != nil {
+		log.Println("Error on creating the task runner: " + err.Error())
+		task.State = TaskFailed
+		if _, err := reporter.Report(ctx, task); err != nil {
+			log.Println("Error on reporting task: " + err.Error())
+		}
+		return
+	}
+
+	var cancel context.CancelFunc
+	if task.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(task.Timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
 
 	stateChanges := make(chan TaskState)
-	go taskExecutor.Execute(task, stateChanges)
+	go Execute(ctx, runner, task, stateChanges)
+
+	//The reports are sent when some command starts or ends, but not more often than
+	//MinReportInterval, and at least once per report interval (heartbeat)
+	interval := reportInterval(task)
+	heartbeat := time.After(interval)
+	var lastReport time.Time
+	//It fires when a report postponed by MinReportInterval may be sent
+	var postponedReport <-chan time.Time
+
+	//The command whose timeout has expired, if any
+	var timedOutCmd *Command
+	//It fires when the timeout of the running command expires
+	var commandDeadline <-chan time.Time
+
+	checkCommandTimeout := func() {
+		cmd, deadline, ok := runningCommandDeadline(task)
+		if !ok || timedOutCmd != nil {
+			commandDeadline = nil
+			return
+		}
+		if time.Now().Before(deadline) {
+			commandDeadline = time.After(time.Until(deadline))
+			return
+		}
+		log.Printf("The command [%s] of the task [%v] has timed out", cmd.RawCommand, task.ID)
+		timedOutCmd = cmd
+		commandDeadline = nil
+		cancel()
+	}
 
-	ticker := time.NewTicker(time.Duration(task.ReportInterval) * time.Second)
+	report := func(results []CommandResult) {
+		updateTaskProgress(task, results)
+		checkCommandTimeout()
+		cancelled, err := reporter.Report(ctx, task)
+		if err != nil {
+			log.Println("Error on reporting task: " + err.Error())
+		}
+		if cancelled {
+			log.Printf("The task [%v] has been cancelled by the server", task.ID)
+			cancel()
+		}
+		lastReport = time.Now()
+		postponedReport = nil
+		heartbeat = time.After(interval)
+	}
 
 	for {
 		select {
-		case <-ticker.C:
-			w.sendTaskReport(task, taskExecutor, serverEndPoint)
+		case <-heartbeat:
+			//nothing may have changed, so the results are read from the container
+			results, err := runner.Track()
+			if err != nil {
+				log.Println(err)
+			}
+			report(results)
+		case <-runner.Changes():
+			updateTaskProgress(task, runner.Results())
+			checkCommandTimeout()
+			if elapsed := time.Since(lastReport); elapsed >= MinReportInterval {
+				report(runner.Results())
+			} else if postponedReport == nil {
+				postponedReport = time.After(MinReportInterval - elapsed)
+			}
+		case <-postponedReport:
+			report(runner.Results())
+		case <-commandDeadline:
+			updateTaskProgress(task, runner.Results())
+			checkCommandTimeout()
 		case state := <-stateChanges:
 			task.State = state
-			ticker.Stop()
-			w.sendTaskReport(task, taskExecutor, serverEndPoint)
+			setOutputs(task, runner.Outputs())
+			results, err := runner.Track()
+			if err != nil {
+				log.Println(err)
+			}
+			updateTaskProgress(task, results)
+			if timedOutCmd != nil && state == TaskCancelled {
+				task.State = TaskTimedOut
+			}
+			if task.State == TaskTimedOut || task.State == TaskCancelled {
+				markKilled(task)
+			}
+			if task.State == TaskTimedOut {
+				markTimedOut(task, timedOutCmd)
+			}
+			//the final report must be sent even if the execution has been cancelled
+			if _, err := reporter.Report(context.Background(), task); err != nil {
+				log.Println("Error on reporting task: " + err.Error())
+			}
 			return
 		}
 
 	}
 }
 
-func (w *Worker) sendTaskReport(task *Task, executor *TaskExecutor, serverEndPoint string) {
-	updateTaskProgress(task, executor)
-	url := serverEndPoint + "/workers/" + w.ID.String() + "/queues/" + fmt.Sprint(w.QueueID) + "/tasks"
+//It creates the runner that executes the task, according to the worker's Runner.
+func (w *Worker) newRunner(task *Task) (TaskRunner, error) {
+	switch w.Runner {
+	case "", RunnerDocker:
+		cli, err := w.dockerClient()
+		if err != nil {
+			return nil, err
+		}
+		return &DockerRunner{Cli: cli, Limits: w.TaskLimits(task)}, nil
+	case RunnerProcess:
+		return &ProcessRunner{}, nil
+	case RunnerSandbox:
+		return &SandboxRunner{Rootfs: w.Rootfs}, nil
+	case RunnerFake:
+		return &FakeRunner{}, nil
+	}
+	return nil, CheckRunner(w.Runner)
+}
 
-	header := http.Header{}
-	header.Set("arrebol-worker-token", w.Token)
+//It returns the interval between the task's heartbeat reports: its ReportInterval,
+//or DefaultReportInterval if it is not set, bounded by MinReportInterval and MaxReportInterval.
+func reportInterval(task *Task) time.Duration {
+	interval := time.Duration(task.ReportInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+	if interval < MinReportInterval {
+		interval = MinReportInterval
+	}
+	if interval > MaxReportInterval {
+		interval = MaxReportInterval
+	}
+	return interval
+}
+
+//It returns the running command of the task, when it has a timeout,
+//and the moment in which its timeout expires.
+func runningCommandDeadline(task *Task) (*Command, time.Time, bool) {
+	for _, cmd := range task.Commands {
+		if cmd.State == CmdRunning && cmd.Timeout > 0 && cmd.StartedAt != nil {
+			return cmd, cmd.StartedAt.Add(time.Duration(cmd.Timeout) * time.Second), true
+		}
+	}
+	return nil, time.Time{}, false
+}
 
-	resp, err := utils.Put(w.ID.String(), task, header, url)
+//It sets the state of the command that has timed out to CmdTimedOut.
+//When it is not known (e.g the task's own Timeout has expired),
+//the commands that were running are the ones that have timed out.
+func markTimedOut(task *Task, timedOutCmd *Command) {
+	if timedOutCmd != nil {
+		timedOutCmd.State = CmdTimedOut
+		return
+	}
+	for _, cmd := range task.Commands {
+		if cmd.State == CmdRunning {
+			cmd.State = CmdTimedOut
+		}
+	}
+}
 
-	if err != nil || resp.StatusCode != 200 {
-		log.Println("Error on reporting task: " + err.Error())
+//It sets the signal that the worker has sent (see killSignal) to the commands
+//that were still running when the task has been interrupted.
+func markKilled(task *Task) {
+	for _, cmd := range task.Commands {
+		if cmd.State == CmdRunning {
+			cmd.Signal = killSignal
+		}
 	}
 }
 
-func updateTaskProgress(task *Task, executor *TaskExecutor) {
-	executedCmdsLen, err := executor.Track()
+//The server's answer to a task report
+type reportResponse struct {
+	//The task state known by the server. When it is TaskCancelled,
+	//the worker must stop executing the task.
+	State TaskState
+}
+
+//It sends the task's current progress to the server.
+//It returns:
+//1. true and nil if the server has answered that the task has been cancelled
+//2. false and nil if the report has been accepted
+//3. false and an *apierrors.Error otherwise
+func (w *Worker) sendTaskReport(ctx context.Context, task *Task, serverEndPoint string) (bool, error) {
+	token, queueID := w.credentials()
+	url := serverEndPoint + "/workers/" + w.ID.String() + "/queues/" + fmt.Sprint(queueID) + "/tasks"
+
+	header := http.Header{}
+	header.Set("arrebol-worker-token", token)
+
+	resp, err := utils.Put(ctx, w.ID.String(), task, header, url)
 
 	if err != nil {
-		log.Println(err)
+		return false, err
 	}
 
-	task.Progress = executedCmdsLen * 100 / len(task.Commands)
+	if err := apierrors.FromResponse("report task", resp.StatusCode, resp.Headers, resp.Body); err != nil {
+		return false, err
+	}
 
-	log.Println("progess: " + strconv.Itoa(task.Progress))
+	var parsedBody reportResponse
+	if err := json.Unmarshal(resp.Body, &parsedBody); err != nil {
+		//the server is not required to answer with the task state
+		return false, nil
+	}
+
+	return parsedBody.State == TaskCancelled, nil
 }
 
-func parseToken(tokenStr string) (map[string]interface{}, error) {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return utils.GetPublicKey("server"), nil
-	})
+func updateTaskProgress(task *Task, results []CommandResult) {
+	finishedCmdsLen := updateCommands(task.Commands, results)
 
-	if err != nil {
-		return nil, err
+	if len(task.Commands) == 0 {
+		task.Progress = 100
+	} else {
+		task.Progress = finishedCmdsLen * 100 / len(task.Commands)
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, errors.New("Error on parsing token")
+	log.Println("progess: " + strconv.Itoa(task.Progress))
+}
+
+//It sets the exit code, state and times of each command according
+//to the tracked results. The commands without results are considered
+//not started. It returns how many commands have finished.
+func updateCommands(cmds []*Command, results []CommandResult) int {
+	finished := 0
+	for i, cmd := range cmds {
+		if i >= len(results) {
+			cmd.State = CmdNotStarted
+			continue
+		}
+
+		result := results[i]
+		startedAt := result.StartedAt
+		cmd.StartedAt = &startedAt
+
+		if !result.Finished() {
+			cmd.State = CmdRunning
+			continue
+		}
+
+		finishedAt := result.FinishedAt
+		cmd.FinishedAt = &finishedAt
+		cmd.ExitCode = result.ExitCode
+		if result.ExitCode == 0 {
+			cmd.State = CmdFinished
+		} else {
+			cmd.State = CmdFailed
+		}
+		finished++
 	}
+	return finished
 }
@@ -1,22 +1,41 @@
 package worker
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
-	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/ufcg-lsd/arrebol-pb-worker/apierrors"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
 )
 
 var (
 	workerTestInstance = Worker{
+		Base:    Base{ID: uuid.NewV4()},
 		Vcpu:    1,
 		Ram:     3,
 		Token:   "test-token",
-		Id:      "1023",
-		QueueId: 932,
+		QueueID: 932,
 	}
 )
 
@@ -31,8 +50,17 @@ func (c *MockedClient) Do(req *http.Request) (*http.Response, error) {
 	return GetDo()
 }
 
+//It gives the workers and the server Ed25519 key pairs, kept in memory, to sign their messages.
+func fakeKeys(workerIds ...string) {
+	utils.Keys = utils.NewMemoryKeyStore()
+	for _, id := range append(workerIds, ServerKeyName) {
+		_, privateKey, _ := ed25519.GenerateKey(nil)
+		utils.Keys.Save(id, privateKey)
+	}
+}
+
 func TestParseWorkerConfiguration(t *testing.T) {
-	testingWorkerAsByte, err := json.Marshal(workerTestInstance)
+	testingWorkerAsByte, err := json.Marshal(&workerTestInstance)
 
 	if err != nil {
 
@@ -41,17 +69,10 @@ func TestParseWorkerConfiguration(t *testing.T) {
 	}
 
 	parsedWorker := ParseWorkerConfiguration(bytes.NewReader(testingWorkerAsByte))
-	log.Println(parsedWorker)
-	log.Println(workerTestInstance)
-
-	expectedWorker := Worker{
-		Vcpu:    workerTestInstance.Vcpu,
-		Ram:     workerTestInstance.Ram,
-		Id:      workerTestInstance.Id,
-		QueueId: workerTestInstance.QueueId,
-	}
 
-	if parsedWorker != expectedWorker {
+	if parsedWorker.Base != (Base{ID: workerTestInstance.ID}) || parsedWorker.Vcpu != workerTestInstance.Vcpu ||
+		parsedWorker.Ram != workerTestInstance.Ram || parsedWorker.QueueID != workerTestInstance.QueueID ||
+		parsedWorker.Token != "" {
 		t.Errorf("The parsed worked is different from the expected one")
 	}
 }
@@ -63,27 +84,36 @@ func TestHandleSubscriptionResponse(t *testing.T) {
 
 	bodyAsByte, _ := json.Marshal(body)
 
-	ParseToken = func(tokenStr string) (map[string]interface{}, error) {
-		return map[string]interface{}{"QueueId": uint(192038)}, nil
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	ParseToken = func(tokenStr string, workerId string) (map[string]interface{}, error) {
+		return map[string]interface{}{"QueueId": float64(192038), "exp": float64(expiresAt.Unix())}, nil
 	}
 
 	//exercise
-	HandleJoinResponse(&utils.HttpResponse{Body: bodyAsByte, StatusCode: 201}, &workerTestInstance)
+	err := HandleJoinResponse(&utils.HttpResponse{Body: bodyAsByte, StatusCode: 201}, &workerTestInstance)
 
 	//verification
-	if workerTestInstance.QueueId != 192038 {
+	if err != nil {
+		t.Error("Error on handling the join response: " + err.Error())
+	}
+
+	if workerTestInstance.QueueID != 192038 {
 		t.Errorf("QueueId is not the expected one")
 	}
 
 	if workerTestInstance.Token != "test-token" {
 		t.Errorf("The token is not the expected one")
 	}
+
+	if !workerTestInstance.TokenExpiresAt().Equal(expiresAt) {
+		t.Errorf("The token expiration is not the expected one")
+	}
 }
 
 func TestWorker_GetTask(t *testing.T) {
 	//setup
-	task := make(map[string]string)
-	task["Id"] = "1"
+	task := make(map[string]uint)
+	task["ID"] = 1
 
 	byteTask, err := json.Marshal(&task)
 
@@ -91,43 +121,38 @@ func TestWorker_GetTask(t *testing.T) {
 		log.Fatal("Error on marshalling test task")
 	}
 
-	body := ioutil.NopCloser(bytes.NewReader(byteTask))
+	fakeKeys(workerTestInstance.ID.String())
 
-	GetDo = func() (*http.Response, error) {
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		utils.SignResponse(header, 200, byteTask, req, ServerKeyName)
 		resp := &http.Response{
 			StatusCode: 200,
-			Header:     nil,
-			Body:       body,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader(byteTask)),
 		}
 		return resp, nil
-	}
-
-	utils.Client = &MockedClient{}
-
-	utils.GetSignature = func(payload interface{}, workerId string) []byte {
-		fakeSignature, _ := json.Marshal("FAKE-SIGNATURE")
-		return fakeSignature
-	}
+	}}
 
 	//exercise
-	mockedTask, err := workerTestInstance.GetTask("http://test-server:8000/v1")
+	mockedTask, err := workerTestInstance.GetTask(context.Background(), "http://test-server:8000/v1")
 
 	//verify
 	if err != nil {
 		t.Error("Error on getting task: " + err.Error())
 	}
 
-	if mockedTask.Id != "1" {
+	if mockedTask.ID != 1 {
 		t.Error("The task Id is different from the expected one")
 	}
 }
 
 func TestWorker_GetTaskWithEmptyQueue(t *testing.T) {
 	//setup
-	workerTestInstance.QueueId = 0
+	workerTestInstance.QueueID = 0
 
 	//exercise
-	mockedTask, err := workerTestInstance.GetTask("http://test-server:8000/v1")
+	mockedTask, err := workerTestInstance.GetTask(context.Background(), "http://test-server:8000/v1")
 
 	//verify
 	if err == nil {
@@ -138,3 +163,1634 @@ func TestWorker_GetTaskWithEmptyQueue(t *testing.T) {
 		t.Error("The expected error has not occurred")
 	}
 }
+
+func TestWorker_Slots(t *testing.T) {
+	cases := []struct {
+		vcpu  float32
+		ram   uint32
+		slots int
+	}{
+		{vcpu: 32, ram: 64 * 1024, slots: 32},
+		{vcpu: 32, ram: 4 * MinRamPerSlot, slots: 4},
+		{vcpu: 2.5, ram: 16 * 1024, slots: 2},
+		{vcpu: 0.5, ram: 16 * 1024, slots: 1},
+		{vcpu: 1, ram: 3, slots: 1},
+	}
+
+	for _, c := range cases {
+		w := Worker{Vcpu: c.vcpu, Ram: c.ram}
+
+		if slots := w.Slots(); slots != c.slots {
+			t.Errorf("Worker with %v vcpu and %v ram: expected %d slots, got %d", c.vcpu, c.ram, c.slots, slots)
+		}
+	}
+}
+
+func TestWorker_TaskLimits(t *testing.T) {
+	w := Worker{Vcpu: 4, Ram: 4096}
+
+	limits := w.TaskLimits(&Task{})
+	if limits.Vcpu != 1 || limits.Ram != 1024 || limits.PidsLimit != DefaultPidsLimit {
+		t.Errorf("Unexpected limits for a task without requirements: %+v", limits)
+	}
+
+	limits = w.TaskLimits(&Task{Vcpu: 0.5, Ram: 512})
+	if limits.Vcpu != 0.5 || limits.Ram != 512 {
+		t.Errorf("The task requirements were not honored: %+v", limits)
+	}
+
+	//each task takes a single slot, so it can't use more than its share
+	limits = w.TaskLimits(&Task{Vcpu: 16, Ram: 8192})
+	if limits.Vcpu != 1 || limits.Ram != 1024 {
+		t.Errorf("The limits must not exceed the share of one slot: %+v", limits)
+	}
+
+	if limits = w.TaskLimits(&Task{Ram: 2}); limits.Ram != MinTaskRam {
+		t.Errorf("Expected the Ram limit to be raised to %d, got %+v", MinTaskRam, limits)
+	}
+
+	w.PidsLimit = 64
+	if limits = w.TaskLimits(&Task{}); limits.PidsLimit != 64 {
+		t.Errorf("The worker PidsLimit was not honored: %+v", limits)
+	}
+}
+
+func TestWorker_CheckResources(t *testing.T) {
+	cases := []struct {
+		vcpu  float32
+		ram   uint32
+		valid bool
+	}{
+		{vcpu: 4, ram: 4096, valid: true},
+		{vcpu: 0.5, ram: MinTaskRam, valid: true},
+		{vcpu: 1, ram: 2, valid: false},
+		{vcpu: 0, ram: 4096, valid: false},
+	}
+
+	for _, c := range cases {
+		w := Worker{Vcpu: c.vcpu, Ram: c.ram}
+
+		if err := w.CheckResources(); (err == nil) != c.valid {
+			t.Errorf("Worker with %v vcpu and %v ram: expected valid=%v, got %v", c.vcpu, c.ram, c.valid, err)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	events := `{"event":"start","index":0,"time":1590000000}
+{"event":"end","index":0,"time":1590000002,"exitCode":0}
+{"event":"start","index":1,"time":1590000002}
+{"event":"end","index":1,"time":1590000010,"exitCode":255}
+{"event":"start","index":2,"time":1590000010}
+{"event":"end","index":2,"time":1590000011,"exitCode":137}
+{"event":"start","index":3,"time":1590000011}
+{"event":"start","index":2000000000,"time":0}
+{"event":"end","index":-1,"time":0,"exitCode":1}
+{"event":"end","ind`
+	results := parseEvents([]byte(events), 4)
+
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 commands results, got %d", len(results))
+	}
+
+	if results[1].StartedAt.Unix() != 1590000002 || results[1].FinishedAt.Unix() != 1590000010 {
+		t.Errorf("Unexpected times for the second command: %+v", results[1])
+	}
+
+	if results[1].ExitCode != 255 {
+		t.Errorf("Expected the exit code 255, got %d", results[1].ExitCode)
+	}
+
+	if results[2].ExitCode != 137 {
+		t.Errorf("Expected the exit code 137, got %d", results[2].ExitCode)
+	}
+
+	if results[3].Finished() {
+		t.Errorf("The running command must not have a finish time")
+	}
+}
+
+func TestUpdateCommands(t *testing.T) {
+	cmds := []*Command{{RawCommand: "true"}, {RawCommand: "false"}, {RawCommand: "sleep 10"}, {RawCommand: "echo"}}
+	start := time.Unix(1590000000, 0)
+	results := []CommandResult{
+		{ExitCode: 0, StartedAt: start, FinishedAt: start.Add(time.Second)},
+		{ExitCode: 1, StartedAt: start.Add(time.Second), FinishedAt: start.Add(2 * time.Second)},
+		{StartedAt: start.Add(2 * time.Second)},
+	}
+
+	finished := updateCommands(cmds, results)
+
+	if finished != 2 {
+		t.Errorf("Expected 2 finished commands, got %d", finished)
+	}
+
+	expectedStates := []CommandState{CmdFinished, CmdFailed, CmdRunning, CmdNotStarted}
+	for i, cmd := range cmds {
+		if cmd.State != expectedStates[i] {
+			t.Errorf("Command %d: expected state %v, got %v", i, expectedStates[i], cmd.State)
+		}
+	}
+
+	if cmds[1].ExitCode != 1 || !cmds[1].FinishedAt.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Unexpected exit code or finish time of the failed command")
+	}
+
+	if cmds[2].StartedAt == nil || cmds[2].FinishedAt != nil {
+		t.Errorf("The running command must have only its start time")
+	}
+}
+
+func TestWorker_SendTaskReportWithCancelledTask(t *testing.T) {
+	//setup
+	GetDo = func() (*http.Response, error) {
+		body, _ := json.Marshal(map[string]TaskState{"State": TaskCancelled})
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}
+
+	utils.Client = &MockedClient{}
+	fakeKeys(workerTestInstance.ID.String())
+	task := &Task{ID: 1, Commands: []*Command{{RawCommand: "sleep 100"}}}
+
+	//exercise
+	cancelled, err := workerTestInstance.sendTaskReport(context.Background(), task, "http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Error("Error on reporting the task: " + err.Error())
+	}
+
+	if !cancelled {
+		t.Error("The task cancellation has not been detected")
+	}
+}
+
+func TestWorker_SendTaskReportWithRunningTask(t *testing.T) {
+	//setup
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+
+	utils.Client = &MockedClient{}
+	fakeKeys(workerTestInstance.ID.String())
+	task := &Task{ID: 1, Commands: []*Command{{RawCommand: "sleep 100"}}}
+
+	//exercise
+	cancelled, err := workerTestInstance.sendTaskReport(context.Background(), task, "http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Error("Error on reporting the task: " + err.Error())
+	}
+
+	if cancelled {
+		t.Error("The task has not been cancelled")
+	}
+}
+
+func TestRunningCommandDeadline(t *testing.T) {
+	start := time.Unix(1590000000, 0)
+	task := &Task{Commands: []*Command{
+		{State: CmdFinished, Timeout: 5, StartedAt: &start},
+		{State: CmdRunning, Timeout: 10, StartedAt: &start},
+	}}
+
+	cmd, deadline, ok := runningCommandDeadline(task)
+
+	if !ok || cmd != task.Commands[1] {
+		t.Fatal("The running command has not been found")
+	}
+
+	if !deadline.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Unexpected deadline: %v", deadline)
+	}
+
+	task.Commands[1].Timeout = 0
+	if _, _, ok = runningCommandDeadline(task); ok {
+		t.Error("A command without timeout must not have a deadline")
+	}
+}
+
+func TestMarkTimedOut(t *testing.T) {
+	task := &Task{Commands: []*Command{{State: CmdFinished}, {State: CmdRunning}, {State: CmdNotStarted}}}
+
+	markTimedOut(task, nil)
+
+	expectedStates := []CommandState{CmdFinished, CmdTimedOut, CmdNotStarted}
+	for i, cmd := range task.Commands {
+		if cmd.State != expectedStates[i] {
+			t.Errorf("Command %d: expected state %v, got %v", i, expectedStates[i], cmd.State)
+		}
+	}
+}
+
+func TestWorker_Leave(t *testing.T) {
+	//setup
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 204, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+
+	utils.Client = &MockedClient{}
+	fakeKeys(workerTestInstance.ID.String())
+
+	//exercise
+	err := workerTestInstance.Leave("http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Error("Error on leaving the server: " + err.Error())
+	}
+}
+
+func TestWorker_GetTaskWithNoTaskAvailable(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, QueueID: 932}
+	utils.Client = &MockedClient{}
+	fakeKeys(worker.ID.String())
+
+	responses := []*http.Response{
+		{StatusCode: 204, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))},
+		{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))},
+		{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte("null")))},
+	}
+
+	for _, resp := range responses {
+		GetDo = func() (*http.Response, error) {
+			return resp, nil
+		}
+
+		//exercise
+		task, err := worker.GetTask(context.Background(), "http://test-server:8000/v1")
+
+		//verify
+		if !errors.Is(err, ErrNoTaskAvailable) {
+			t.Errorf("Expected ErrNoTaskAvailable for status %d, got %v", resp.StatusCode, err)
+		}
+
+		if task != nil {
+			t.Error("No task was expected")
+		}
+	}
+}
+
+func TestWorker_GetTaskFromUnknownQueue(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, QueueID: 932}
+	utils.Client = &MockedClient{}
+	fakeKeys(worker.ID.String())
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+
+	//exercise
+	task, err := worker.GetTask(context.Background(), "http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, apierrors.ErrNotFound) || errors.Is(err, ErrNoTaskAvailable) {
+		t.Errorf("Expected a NotFound error, not an empty queue, got %v", err)
+	}
+
+	if task != nil {
+		t.Error("No task was expected")
+	}
+}
+
+func TestWorker_GetTaskWithRetryAfter(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, QueueID: 932}
+	utils.Client = &MockedClient{}
+	fakeKeys(worker.ID.String())
+
+	GetDo = func() (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Retry-After", "120")
+		return &http.Response{StatusCode: 204, Header: header, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+
+	//exercise
+	_, err := worker.GetTask(context.Background(), "http://test-server:8000/v1")
+
+	//verify
+	if retryAfter := apierrors.RetryAfter(err); retryAfter != 120*time.Second {
+		t.Errorf("Expected to retry after 120s, got %s", retryAfter)
+	}
+
+	if !errors.Is(err, ErrNoTaskAvailable) {
+		t.Errorf("Expected ErrNoTaskAvailable, got %v", err)
+	}
+}
+
+func TestWorker_GetTaskWithExpiredToken(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, QueueID: 932}
+	utils.Client = &MockedClient{}
+	fakeKeys(worker.ID.String())
+
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewReader([]byte("expired token")))}, nil
+	}
+
+	//exercise
+	_, err := worker.GetTask(context.Background(), "http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, apierrors.ErrAuth) {
+		t.Errorf("Expected an auth error, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if next := b.next(); next != e {
+			t.Errorf("Attempt %d: expected %s, got %s", i, e, next)
+		}
+	}
+
+	b.reset()
+	if next := b.next(); next != time.Second {
+		t.Errorf("Expected the backoff to start over, got %s", next)
+	}
+}
+
+func TestHandleJoinResponseWithRefusedWorker(t *testing.T) {
+	//setup
+	w := Worker{}
+
+	//exercise
+	err := HandleJoinResponse(&utils.HttpResponse{Body: []byte("conflict"), StatusCode: 409}, &w)
+
+	//verification
+	if !errors.Is(err, apierrors.ErrConflict) {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+
+	if apiErr, ok := err.(*apierrors.Error); !ok || apiErr.StatusCode != 409 || string(apiErr.Body) != "conflict" {
+		t.Errorf("The status code and body must be attached to the error: %v", err)
+	}
+}
+
+func setupKeys(t *testing.T) func() {
+	previousKeys, previousSize := utils.Keys, utils.KeyBitSize
+	utils.Keys = utils.NewMemoryKeyStore()
+	utils.KeyBitSize = 2048
+
+	if err := utils.LoadOrGenAccessKeys(workerTestInstance.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		utils.Keys = previousKeys
+		utils.KeyBitSize = previousSize
+	}
+}
+
+func TestWorker_JoinRecoversFromTransportErrors(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	previousRetry, previousParseToken := utils.Retry, ParseToken
+	defer func() { utils.Retry, ParseToken = previousRetry, previousParseToken }()
+	utils.Retry = utils.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	ParseToken = func(tokenStr string, workerId string) (map[string]interface{}, error) {
+		return map[string]interface{}{"QueueId": float64(7)}, nil
+	}
+	attempts := 0
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		body, _ := json.Marshal(map[string]string{"arrebol-worker-token": "new-token"})
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}}
+	worker := Worker{Base: workerTestInstance.Base}
+
+	//exercise
+	err := worker.Join("http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Fatal("Error on joining the server: " + err.Error())
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected the join to be sent again after the transport error, got %d attempt(s)", attempts)
+	}
+
+	if token, queueID := worker.credentials(); token != "new-token" || queueID != 7 {
+		t.Errorf("Unexpected credentials after joining: %s, %d", token, queueID)
+	}
+}
+
+func TestWorker_JoinWithoutKeys(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	worker := Worker{Base: workerTestInstance.Base}
+	utils.Keys.Remove(worker.ID.String())
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Unexpected request to the server: %s %s", req.Method, req.URL)
+		return nil, errors.New("unexpected request")
+	}}
+
+	for name, operation := range map[string]func(string) error{"join": worker.Join, "rotate keys": worker.RotateKeys} {
+		//exercise
+		err := operation("http://test-server:8000/v1")
+
+		//verify
+		var apiErr *apierrors.Error
+		if !errors.As(err, &apiErr) || apiErr.Kind != apierrors.Unknown || !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Errorf("%s: expected an *apierrors.Error of the unknown kind wrapping the missing key, got %v", name, err)
+		}
+	}
+}
+
+func TestWorker_RotateKeys(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	id := workerTestInstance.ID.String()
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+	utils.Client = &MockedClient{}
+	oldPublicKey, _ := utils.GetBase64PubKey(id)
+
+	//exercise
+	err := workerTestInstance.RotateKeys("http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Error("Error on rotating the keys: " + err.Error())
+	}
+
+	if newPublicKey, _ := utils.GetBase64PubKey(id); newPublicKey == oldPublicKey {
+		t.Error("The public key has not been replaced")
+	}
+}
+
+func TestWorker_RotateKeysWithoutToken(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	previousParseToken := ParseToken
+	defer func() { ParseToken = previousParseToken }()
+	ParseToken = func(tokenStr string, workerId string) (map[string]interface{}, error) {
+		return map[string]interface{}{"QueueId": float64(7)}, nil
+	}
+	var requests []string
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path+" "+req.Header.Get("arrebol-worker-token"))
+		if strings.HasSuffix(req.URL.Path, "/workers") {
+			body, _ := json.Marshal(map[string]string{"arrebol-worker-token": "new-token"})
+			return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}}
+	worker := Worker{Base: workerTestInstance.Base}
+	id := worker.ID.String()
+	oldPublicKey, _ := utils.GetBase64PubKey(id)
+
+	//exercise
+	err := worker.RotateKeys("http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Fatal("Error on rotating the keys: " + err.Error())
+	}
+
+	expected := []string{"POST /v1/workers ", "POST /v1/workers/" + id + "/keys new-token"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected the worker to join before rotating the keys: %q", requests)
+	}
+
+	if newPublicKey, _ := utils.GetBase64PubKey(id); newPublicKey == oldPublicKey {
+		t.Error("The public key has not been replaced")
+	}
+}
+
+func TestWorker_RotateKeysRefusedByServer(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	id := workerTestInstance.ID.String()
+	GetDo = func() (*http.Response, error) {
+		return &http.Response{StatusCode: 409, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}
+	utils.Client = &MockedClient{}
+	oldPublicKey, _ := utils.GetBase64PubKey(id)
+
+	//exercise
+	err := workerTestInstance.RotateKeys("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, apierrors.ErrConflict) {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+
+	if newPublicKey, _ := utils.GetBase64PubKey(id); newPublicKey != oldPublicKey {
+		t.Error("The public key has been replaced")
+	}
+}
+
+func TestWorker_RotateKeysKeepsThePendingPairWhenTheOutcomeIsUnclear(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	previousParseToken := ParseToken
+	defer func() { ParseToken = previousParseToken }()
+	ParseToken = func(tokenStr string, workerId string) (map[string]interface{}, error) {
+		return map[string]interface{}{"QueueId": float64(7)}, nil
+	}
+	status := http.StatusInternalServerError
+	var requests []string
+	var rotatedKeys []string
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/workers") {
+			body, _ := json.Marshal(map[string]string{"arrebol-worker-token": "new-token"})
+			return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+		}
+		var rotation struct{ Worker keyRotation }
+		json.NewDecoder(req.Body).Decode(&rotation)
+		rotatedKeys = append(rotatedKeys, rotation.Worker.PublicKey)
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}}
+	worker := Worker{Base: workerTestInstance.Base, Token: "token"}
+	id := worker.ID.String()
+	oldPublicKey, _ := utils.GetBase64PubKey(id)
+
+	//exercise
+	failedErr := worker.RotateKeys("http://test-server:8000/v1")
+	keptPendingPair := utils.HasPendingAccessKeys(id)
+	status = http.StatusOK
+	err := worker.RotateKeys("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(failedErr, apierrors.ErrServer) || !keptPendingPair {
+		t.Errorf("Expected a server error and the pending pair to be kept, got %v and %v", failedErr, keptPendingPair)
+	}
+
+	if err != nil {
+		t.Fatal("Error on rotating the keys: " + err.Error())
+	}
+
+	expected := []string{"POST /v1/workers/" + id + "/keys", "POST /v1/workers", "POST /v1/workers/" + id + "/keys"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected a single attempt, then a join before resuming the rotation: %q", requests)
+	}
+
+	if len(rotatedKeys) != 2 || rotatedKeys[0] != rotatedKeys[1] {
+		t.Error("The pending pair has not been reused")
+	}
+
+	if newPublicKey, _ := utils.GetBase64PubKey(id); newPublicKey == oldPublicKey || utils.HasPendingAccessKeys(id) {
+		t.Error("The pending pair has not been committed")
+	}
+}
+
+func TestWorker_JoinWithThePendingKeyPair(t *testing.T) {
+	//setup
+	defer setupKeys(t)()
+	previousParseToken := ParseToken
+	defer func() { ParseToken = previousParseToken }()
+	ParseToken = func(tokenStr string, workerId string) (map[string]interface{}, error) {
+		return map[string]interface{}{"QueueId": float64(7)}, nil
+	}
+	worker := Worker{Base: workerTestInstance.Base}
+	id := worker.ID.String()
+	currentKey, _ := utils.GetPublicKeyHeader(id)
+	utils.PendingAccessKeys(id)
+	utils.SwapPendingAccessKeys(id)
+	pendingKey, _ := utils.GetPublicKeyHeader(id)
+	utils.SwapPendingAccessKeys(id)
+
+	trustedKey := ""
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get(PUBLIC_KEY) != trustedKey {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+		}
+		body, _ := json.Marshal(map[string]string{"arrebol-worker-token": "new-token"})
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}}
+
+	//exercise
+	refusedErr := worker.Join("http://test-server:8000/v1")
+	keyAfterRefusal, _ := utils.GetPublicKeyHeader(id)
+	pendingAfterRefusal := utils.HasPendingAccessKeys(id)
+	trustedKey = pendingKey
+	err := worker.Join("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(refusedErr, apierrors.ErrAuth) || keyAfterRefusal != currentKey || !pendingAfterRefusal {
+		t.Errorf("Expected an auth error and both key pairs to be kept, got %v", refusedErr)
+	}
+
+	if err != nil {
+		t.Fatal("Error on joining with the pending key pair: " + err.Error())
+	}
+
+	if key, _ := utils.GetPublicKeyHeader(id); key != pendingKey || utils.HasPendingAccessKeys(id) {
+		t.Error("The pending key pair has not become the current one")
+	}
+}
+
+func TestWorker_GetTaskWithInvalidSignature(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, QueueID: 932}
+	fakeKeys(worker.ID.String())
+	byteTask := []byte(`{"ID":7,"Commands":[{"RawCommand":"echo hello"}]}`)
+
+	_, anotherKey, _ := ed25519.GenerateKey(nil)
+	utils.Keys.Save("another", anotherKey)
+	anotherRequest, _ := http.NewRequest(http.MethodGet, "http://test-server:8000/v1/workers/"+worker.ID.String()+"/queues/932/tasks", nil)
+	utils.SignRequest(anotherRequest, worker.ID.String(), nil)
+
+	unsigned := func(header http.Header, req *http.Request) {}
+	signedByAnotherKey := func(header http.Header, req *http.Request) {
+		utils.SignResponse(header, 200, byteTask, req, "another")
+	}
+	tampered := func(header http.Header, req *http.Request) {
+		utils.SignResponse(header, 200, []byte(`{"ID":7}`), req, ServerKeyName)
+	}
+	signedForAnotherRequest := func(header http.Header, req *http.Request) {
+		utils.SignResponse(header, 200, byteTask, anotherRequest, ServerKeyName)
+	}
+
+	for _, sign := range []func(http.Header, *http.Request){unsigned, signedByAnotherKey, tampered, signedForAnotherRequest} {
+		sign := sign
+		utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			sign(header, req)
+			return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewReader(byteTask))}, nil
+		}}
+
+		//exercise
+		task, err := worker.GetTask(context.Background(), "http://test-server:8000/v1")
+
+		//verify
+		if !errors.Is(err, apierrors.ErrSignature) {
+			t.Errorf("Expected a signature error, got %v", err)
+		}
+
+		if task == nil || task.ID != 7 {
+			t.Error("The rejected task should be returned")
+		}
+	}
+}
+
+func TestWorker_RejectTask(t *testing.T) {
+	//setup
+	fakeKeys(workerTestInstance.ID.String())
+	var report Task
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		json.NewDecoder(req.Body).Decode(&report)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}}
+	task := &Task{ID: 7, Commands: []*Command{{RawCommand: "rm -rf /"}}}
+
+	//exercise
+	err := workerTestInstance.RejectTask(task, "http://test-server:8000/v1")
+
+	//verify
+	if err != nil {
+		t.Error("Error on rejecting the task: " + err.Error())
+	}
+
+	if report.ID != 7 || report.State != TaskRejected || len(report.Commands) != 0 {
+		t.Errorf("Unexpected report of the rejected task: %+v", report)
+	}
+}
+
+type requestRecorder struct {
+	do func(req *http.Request) (*http.Response, error)
+}
+
+func (c *requestRecorder) Do(req *http.Request) (*http.Response, error) {
+	return c.do(req)
+}
+
+func serverToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseToken(t *testing.T) {
+	//setup
+	workerId := uuid.NewV4().String()
+	serverKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	fakeKeys()
+	utils.Keys.Save(ServerKeyName, serverKey)
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":      TokenIssuer,
+			"aud":      []interface{}{"another-audience", TokenAudience},
+			"exp":      time.Now().Add(time.Hour).Unix(),
+			"iat":      time.Now().Unix(),
+			"WorkerId": workerId,
+			"QueueId":  932,
+		}
+	}
+	withClaim := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", serverToken(t, jwt.SigningMethodRS256, serverKey, validClaims()), true},
+		{"expired within the leeway", serverToken(t, jwt.SigningMethodRS256, serverKey,
+			withClaim("exp", time.Now().Add(-TokenLeeway/2).Unix())), true},
+		{"expired", serverToken(t, jwt.SigningMethodRS256, serverKey,
+			withClaim("exp", time.Now().Add(-2*TokenLeeway).Unix())), false},
+		{"without exp", serverToken(t, jwt.SigningMethodRS256, serverKey, withClaim("exp", nil)), false},
+		{"not valid yet", serverToken(t, jwt.SigningMethodRS256, serverKey,
+			withClaim("nbf", time.Now().Add(time.Hour).Unix())), false},
+		{"another issuer", serverToken(t, jwt.SigningMethodRS256, serverKey, withClaim("iss", "someone")), false},
+		{"another audience", serverToken(t, jwt.SigningMethodRS256, serverKey, withClaim("aud", "someone")), false},
+		{"another worker", serverToken(t, jwt.SigningMethodRS256, serverKey, withClaim("WorkerId", "someone")), false},
+		{"without queue", serverToken(t, jwt.SigningMethodRS256, serverKey, withClaim("QueueId", nil)), false},
+		{"HMAC signed", serverToken(t, jwt.SigningMethodHS256, []byte("secret"), validClaims()), false},
+		{"unsigned", serverToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, validClaims()), false},
+	}
+
+	for _, c := range cases {
+		//exercise
+		claims, err := parseToken(c.token, workerId)
+
+		//verify
+		if c.valid && (err != nil || claims["QueueId"] != float64(932)) {
+			t.Errorf("%s: the token has been refused: %v", c.name, err)
+		}
+
+		if !c.valid && !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", c.name, err)
+		}
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	now = func() time.Time { return time.Unix(1000, 0) }
+	defer func() { now = time.Now }()
+
+	cases := []struct {
+		expiresAt time.Time
+		expected  time.Duration
+	}{
+		{time.Unix(1000+3600, 0), time.Hour - TokenRefreshMargin},
+		{time.Unix(1000+60, 0), 30 * time.Second},
+		{time.Unix(900, 0), 0},
+	}
+
+	for _, c := range cases {
+		if delay := refreshDelay(c.expiresAt, TokenRefreshMargin); delay != c.expected {
+			t.Errorf("Expected the delay %s, got %s", c.expected, delay)
+		}
+	}
+}
+
+func TestReportInterval(t *testing.T) {
+	cases := []struct {
+		reportInterval int64
+		expected       time.Duration
+	}{
+		{0, DefaultReportInterval},
+		{-5, DefaultReportInterval},
+		{10, 10 * time.Second},
+		{100000, MaxReportInterval},
+	}
+
+	for _, c := range cases {
+		if interval := reportInterval(&Task{ReportInterval: c.reportInterval}); interval != c.expected {
+			t.Errorf("ReportInterval %d: expected %s, got %s", c.reportInterval, c.expected, interval)
+		}
+	}
+
+	defer func(min time.Duration) { MinReportInterval = min }(MinReportInterval)
+	MinReportInterval = 20 * time.Second
+	if interval := reportInterval(&Task{ReportInterval: 10}); interval != MinReportInterval {
+		t.Errorf("Expected the interval to be bounded by MinReportInterval, got %s", interval)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	tracker := &tracker{}
+	stream := &eventStream{tracker: tracker, commands: 2}
+
+	stream.Write([]byte(`{"event":"start","index":0,"time":1590000000}` + "\n" + `{"event":"end","ind`))
+
+	select {
+	case <-tracker.Changes():
+	default:
+		t.Fatal("Expected a change on the start of the command")
+	}
+
+	results := tracker.Results()
+	if len(results) != 1 || results[0].Finished() {
+		t.Fatalf("Expected one running command, got %+v", results)
+	}
+
+	stream.Write([]byte(`ex":0,"time":1590000003,"exitCode":2,"signal":0}` + "\n"))
+	stream.Write([]byte(`{"event":"start","index":1,"time":1590000003}` + "\n"))
+
+	select {
+	case <-tracker.Changes():
+	default:
+		t.Fatal("Expected a change on the end of the command")
+	}
+
+	if results[0].Finished() {
+		t.Error("The results already returned must not change")
+	}
+
+	results = tracker.Results()
+	if len(results) != 2 || results[0].ExitCode != 2 || !results[0].FinishedAt.Equal(time.Unix(1590000003, 0)) {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	//the commands may write to the stream as well
+	stream.Write([]byte(`{"event":"start","index":2000000000,"time":0}` + "\n"))
+	stream.Write(bytes.Repeat([]byte(" "), 2*maxEventSize))
+	stream.Write([]byte(`{"event":"end","index":1,"time":0,"exitCode":1}` + "\n"))
+
+	if results = tracker.Results(); len(results) != 2 || results[1].Finished() {
+		t.Errorf("The forged events have been applied: %+v", results)
+	}
+
+	if len(stream.pending) != 0 {
+		t.Errorf("The dropped line is still pending: %d bytes", len(stream.pending))
+	}
+}
+
+func TestWorker_ExecTaskWithFakeRunner(t *testing.T) {
+	//setup
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, Vcpu: 1, Ram: 1024, QueueID: 932, Runner: RunnerFake}
+	fakeKeys(worker.ID.String())
+	var reports []Task
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		var report Task
+		json.NewDecoder(req.Body).Decode(&report)
+		reports = append(reports, report)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}}
+	task := &Task{ID: 8, Commands: []*Command{{RawCommand: "true"}, {RawCommand: "echo"}}}
+
+	//exercise
+	worker.ExecTask(context.Background(), task, "http://test-server:8000/v1")
+
+	//verify
+	if len(reports) == 0 {
+		t.Fatal("The task has not been reported")
+	}
+
+	final := reports[len(reports)-1]
+	if final.State != TaskFinished || final.Progress != 100 {
+		t.Errorf("Unexpected final report: %+v", final)
+	}
+
+	for i, cmd := range final.Commands {
+		if cmd.State != CmdFinished || cmd.StartedAt == nil || cmd.FinishedAt == nil {
+			t.Errorf("Command %d: unexpected final state %+v", i, cmd)
+		}
+	}
+}
+
+func TestWorker_NewRunner(t *testing.T) {
+	worker := Worker{Vcpu: 1, Ram: 1024}
+
+	for kind, expected := range map[string]TaskRunner{RunnerProcess: &ProcessRunner{}, RunnerFake: &FakeRunner{}} {
+		worker.Runner = kind
+		runner, err := worker.newRunner(&Task{})
+		if err != nil || reflect.TypeOf(runner) != reflect.TypeOf(expected) {
+			t.Errorf("Runner %s: unexpected runner %T (%v)", kind, runner, err)
+		}
+	}
+
+	worker.Runner = "vm"
+	if _, err := worker.newRunner(&Task{}); err == nil {
+		t.Error("Expected an error on creating an unknown runner")
+	}
+}
+
+func TestCheckRunner(t *testing.T) {
+	for _, kind := range []string{"", RunnerDocker, RunnerProcess} {
+		if err := CheckRunner(kind); err != nil {
+			t.Errorf("Runner %s: unexpected error %v", kind, err)
+		}
+	}
+
+	//the fake runner doesn't run the tasks at all, so a worker must not be configured with it
+	for _, kind := range []string{RunnerFake, "vm"} {
+		if CheckRunner(kind) == nil {
+			t.Errorf("Runner %s: expected an error", kind)
+		}
+	}
+}
+
+//It makes the process runners find the task script executor.
+//It returns the function that restores the previous BIN_PATH.
+func setupBinPath(t *testing.T) func() {
+	binPath, err := filepath.Abs("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Getenv("BIN_PATH")
+	os.Setenv("BIN_PATH", binPath)
+	return func() { os.Setenv("BIN_PATH", previous) }
+}
+
+func TestProcessRunner(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	runner := &ProcessRunner{}
+	task := &Task{ID: 9, Commands: []*Command{
+		{RawCommand: "echo arrebol > file && cat file"},
+		{RawCommand: "sh -c 'echo failed >&2; exit 200'"},
+	}}
+	states := make(chan TaskState, 1)
+
+	//exercise
+	Execute(context.Background(), runner, task, states)
+
+	//verify
+	if state := <-states; state != TaskFinished {
+		t.Errorf("Expected the state %v, got %v", TaskFinished, state)
+	}
+
+	results := runner.Results()
+	if len(results) != 2 || results[0].ExitCode != 0 || results[1].ExitCode != 200 || !results[1].Finished() {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	outputs := runner.Outputs()
+	if len(outputs) != 2 || outputs[0].Stdout != "arrebol\n" || outputs[1].Stderr != "failed\n" {
+		t.Errorf("Unexpected outputs: %+v", outputs)
+	}
+
+	if _, err := os.Stat(runner.dir); !os.IsNotExist(err) {
+		t.Error("The scratch directory has not been removed")
+	}
+}
+
+func TestWorker_ExecTaskReportsTheEndOfTheOutputs(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	worker := Worker{Base: Base{ID: uuid.NewV4()}, Vcpu: 1, Ram: 1024, QueueID: 932, Runner: RunnerProcess}
+	fakeKeys(worker.ID.String())
+	var reports []Task
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		var report Task
+		json.NewDecoder(req.Body).Decode(&report)
+		reports = append(reports, report)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+	}}
+	task := &Task{ID: 10, Commands: []*Command{
+		{RawCommand: fmt.Sprintf("head -c %d /dev/zero | tr '\\000' a; echo end", MaxCommandOutputSize)},
+		{RawCommand: "echo failed >&2; exit 1"},
+	}}
+
+	//exercise
+	worker.ExecTask(context.Background(), task, "http://test-server:8000/v1")
+
+	//verify
+	if len(reports) == 0 {
+		t.Fatal("The task has not been reported")
+	}
+
+	final := reports[len(reports)-1]
+	if len(final.Commands) != 2 {
+		t.Fatalf("Unexpected final report: %+v", final)
+	}
+
+	//the output of the first command is 4 bytes longer than the limit
+	if expected := strings.Repeat("a", MaxCommandOutputSize-4) + "end\n"; final.Commands[0].Stdout != expected {
+		t.Errorf("Expected the last %d bytes of the stdout, got %d bytes", MaxCommandOutputSize, len(final.Commands[0].Stdout))
+	}
+
+	if final.Commands[1].Stdout != "" || final.Commands[1].Stderr != "failed\n" {
+		t.Errorf("Unexpected outputs of the second command: %q and %q", final.Commands[1].Stdout, final.Commands[1].Stderr)
+	}
+
+	for _, report := range reports[:len(reports)-1] {
+		for i, cmd := range report.Commands {
+			if cmd.Stdout != "" || cmd.Stderr != "" {
+				t.Errorf("Command %d: the output has been sent before the final report", i)
+			}
+		}
+	}
+}
+
+func TestProcessRunnerWithTimeout(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	runner := &ProcessRunner{}
+	task := &Task{ID: 10, Commands: []*Command{{RawCommand: "sleep 30"}, {RawCommand: "echo never"}}}
+	states := make(chan TaskState, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	//exercise
+	start := time.Now()
+	Execute(ctx, runner, task, states)
+
+	//verify
+	if state := <-states; state != TaskTimedOut {
+		t.Errorf("Expected the state %v, got %v", TaskTimedOut, state)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("The running command has not been killed (%s)", elapsed)
+	}
+
+	if results := runner.Results(); len(results) != 1 || results[0].Finished() {
+		t.Errorf("Expected only the first command to have started, got %+v", results)
+	}
+}
+
+func TestProcessRunner_TrackDuringPrepare(t *testing.T) {
+	//setup
+	runner := &ProcessRunner{}
+	task := &Task{ID: 12, Commands: []*Command{{RawCommand: "true"}}}
+	prepared := make(chan error, 1)
+
+	//exercise
+	go func() {
+		prepared <- runner.Prepare(context.Background(), task)
+	}()
+
+	//verify (the data races are caught by -race)
+	for done := false; !done; {
+		select {
+		case err := <-prepared:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+			if results, _ := runner.Track(); len(results) != 0 {
+				t.Errorf("Expected no results before the task runs, got %+v", results)
+			}
+		}
+	}
+
+	if err := runner.Cleanup(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProcessRunnerWithFIFOOutput(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Skip("mkfifo is not available")
+	}
+	runner := &ProcessRunner{}
+	task := &Task{ID: 11, Commands: []*Command{
+		{RawCommand: "mkfifo fifo && mv fifo task-id.ts.0.out && echo replaced"},
+	}}
+	states := make(chan TaskState, 1)
+
+	//exercise
+	go Execute(context.Background(), runner, task, states)
+
+	//verify
+	select {
+	case state := <-states:
+		if state != TaskFinished {
+			t.Errorf("Expected the state %v, got %v", TaskFinished, state)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The runner has blocked on the FIFO")
+	}
+
+	if results := runner.Results(); len(results) != 1 || results[0].ExitCode != 0 {
+		t.Errorf("The output has not been replaced by a FIFO: %+v", results)
+	}
+
+	if outputs := runner.Outputs(); len(outputs) != 1 || outputs[0].Stdout != "" {
+		t.Errorf("Unexpected outputs: %+v", outputs)
+	}
+}
+
+func TestReadTaskFile_RefusesSpecialFiles(t *testing.T) {
+	//setup
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Skip("mkfifo is not available")
+	}
+	dir, err := ioutil.TempDir("", "arrebol-task-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fifo := filepath.Join(dir, "fifo")
+	regular := filepath.Join(dir, "regular")
+	link := filepath.Join(dir, "link")
+	exec.Command("mkfifo", fifo).Run()
+	ioutil.WriteFile(regular, []byte("output"), 0644)
+	os.Symlink(regular, link)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		//exercise and verify
+		for _, file := range []string{fifo, link} {
+			if _, err := readTaskFile(file, 1024); err == nil {
+				t.Errorf("The task file [%s] has been read", file)
+			}
+			if content := readTail(file, 1024); content != "" {
+				t.Errorf("The task file [%s] has been read: %s", file, content)
+			}
+		}
+
+		if _, err := readTaskFile(regular, 3); err == nil {
+			t.Error("A task file bigger than the limit has been read")
+		}
+
+		if content := readTail(regular, 3); content != "put" {
+			t.Errorf("Expected the end of the file, got %s", content)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The reading has blocked on the FIFO")
+	}
+}
+
+func TestMain(m *testing.M) {
+	//the sandbox runner runs the test binary as the init of each sandbox
+	if len(os.Args) > 1 && os.Args[1] == SandboxInitCommand {
+		SandboxInit()
+	}
+	os.Exit(m.Run())
+}
+
+//It builds a rootfs tarball with the host's programs needed by the task script
+//executor, along with their libraries, skipping the test if some is missing.
+func sandboxRootfs(t *testing.T, dir string) string {
+	programs := map[string]string{"bin/sh": "dash"}
+	for _, program := range []string{"date", "dirname", "basename", "rm", "touch", "cat"} {
+		programs["bin/"+program] = program
+	}
+
+	files := map[string]string{}
+	for name, program := range programs {
+		path, err := exec.LookPath(program)
+		if err != nil {
+			t.Skipf("The program %s is not available: %s", program, err)
+		}
+		files[name] = path
+
+		libraries, err := exec.Command("ldd", path).Output()
+		if err != nil {
+			t.Skipf("The libraries of %s couldn't be listed: %s", program, err)
+		}
+		for _, field := range strings.Fields(string(libraries)) {
+			if strings.HasPrefix(field, "/") {
+				files[strings.TrimPrefix(field, "/")] = field
+			}
+		}
+	}
+
+	rootfs := filepath.Join(dir, "rootfs.tar")
+	f, err := os.Create(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for name, path := range files {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0755, Size: int64(len(content))})
+		tw.Write(content)
+	}
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rootfs
+}
+
+func TestSandboxRunner(t *testing.T) {
+	//setup
+	if runtime.GOOS != "linux" {
+		t.Skip("The sandbox is only available on linux")
+	}
+	defer setupBinPath(t)()
+	dir, _ := ioutil.TempDir("", "sandbox-test")
+	defer os.RemoveAll(dir)
+
+	runner := &SandboxRunner{Rootfs: sandboxRootfs(t, dir)}
+	task := &Task{ID: 11, Commands: []*Command{
+		{RawCommand: "echo sandboxed > file && cat file && echo $HOSTNAME >&2"},
+		{RawCommand: "[ -e " + dir + " ]"},
+		{RawCommand: "sh -c 'exit 3'"},
+	}}
+
+	//exercise
+	if err := runner.Prepare(context.Background(), task); err != nil {
+		runner.Cleanup()
+		t.Fatal(err)
+	}
+	err := runner.Run(context.Background())
+	runner.Cleanup()
+
+	//verify
+	var startErr *os.PathError
+	if errors.As(err, &startErr) && startErr.Op == "fork/exec" {
+		t.Skipf("The namespaces couldn't be created: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := runner.Results()
+	if len(results) != 3 || results[0].ExitCode != 0 || results[1].ExitCode != 1 || results[2].ExitCode != 3 {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	outputs := runner.Outputs()
+	if len(outputs) != 3 || outputs[0].Stdout != "sandboxed\n" || outputs[0].Stderr != "arrebol\n" {
+		t.Errorf("Unexpected outputs: %+v", outputs)
+	}
+
+	if _, err := os.Stat(runner.dir); !os.IsNotExist(err) {
+		t.Error("The scratch directory has not been removed")
+	}
+}
+
+func TestSandboxRunner_DetectShell(t *testing.T) {
+	//setup
+	root, _ := ioutil.TempDir("", "sandbox-shell")
+	defer os.RemoveAll(root)
+	runner := &SandboxRunner{root: root}
+	shells := []string{"/busybox/sh", "/bin/sh"}
+
+	//exercise and verify
+	if _, err := runner.detectShell(); !errors.Is(err, utils.ErrNoShell) {
+		t.Errorf("Expected ErrNoShell on a root filesystem without shells, got %v", err)
+	}
+
+	for _, shell := range shells {
+		path := filepath.Join(root, shell)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, nil, 0755)
+
+		if detected, err := runner.detectShell(); detected != shell || err != nil {
+			t.Errorf("Expected the shell %s, got %s %v", shell, detected, err)
+		}
+	}
+}
+
+func TestReadTaskFile(t *testing.T) {
+	//setup
+	dir, _ := ioutil.TempDir("", "task-files")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"task.json": `{"ID": 5, "DockerImage": "alpine", "Timeout": 60, "Commands": [{"RawCommand": "echo a"}, {"RawCommand": "echo b"}]}`,
+		"task.yaml": "id: 5\ndockerImage: alpine\ntimeout: 60\ncommands:\n  - RawCommand: echo a\n  - rawcommand: echo b\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(content), 0644)
+
+		//exercise
+		task, err := ReadTaskFile(path)
+
+		//verify
+		if err != nil {
+			t.Fatalf("Unexpected error on reading %s: %s", name, err)
+		}
+		if task.ID != 5 || task.DockerImage != "alpine" || task.Timeout != 60 || len(task.Commands) != 2 ||
+			task.Commands[0].RawCommand != "echo a" || task.Commands[1].RawCommand != "echo b" {
+			t.Errorf("Unexpected task read from %s: %+v", name, task)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.yml")
+	ioutil.WriteFile(empty, []byte("dockerImage: alpine\n"), 0644)
+	if _, err := ReadTaskFile(empty); err == nil {
+		t.Error("Expected an error on reading a task without commands")
+	}
+}
+
+func TestWorker_RunLocal(t *testing.T) {
+	//setup
+	worker := Worker{Runner: RunnerFake}
+	utils.Client = &requestRecorder{do: func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Unexpected request to the server: %s %s", req.Method, req.URL)
+		return nil, errors.New("unexpected request")
+	}}
+	task := &Task{Commands: []*Command{{RawCommand: "echo a"}, {RawCommand: "echo b"}, {RawCommand: "echo c"}}}
+	var out bytes.Buffer
+
+	//exercise
+	exitCode := worker.RunLocal(context.Background(), task, &out)
+
+	//verify
+	if exitCode != 0 || task.State != TaskFinished {
+		t.Errorf("Expected the exit code 0 and the state %v, got %d and %v", TaskFinished, exitCode, task.State)
+	}
+
+	for _, line := range []string{"[1/3] started: echo a", "[3/3] exited with code 0", "Progress: 100%", "--- [2/3] echo b: exited with code 0"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected the line [%s] in the output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestWorker_RunLocalReportsOnlyTheSignalsSentByTheWorker(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	worker := Worker{Runner: RunnerProcess}
+	task := &Task{Commands: []*Command{{RawCommand: "sh -c 'kill -9 $$'"}, {RawCommand: "sh -c 'exit 130'"}, {RawCommand: "sleep 30"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(time.Second, cancel)
+	var out bytes.Buffer
+
+	//exercise
+	worker.RunLocal(ctx, task, &out)
+
+	//verify
+	if task.State != TaskCancelled {
+		t.Fatalf("Expected the state %v, got %v:\n%s", TaskCancelled, task.State, out.String())
+	}
+
+	for i, expected := range []struct{ exitCode, signal int }{{137, 0}, {130, 0}, {0, killSignal}} {
+		if cmd := task.Commands[i]; cmd.ExitCode != expected.exitCode || cmd.Signal != expected.signal {
+			t.Errorf("Expected the command [%s] to have the exit code %d and the signal %d, got %d and %d",
+				cmd.RawCommand, expected.exitCode, expected.signal, cmd.ExitCode, cmd.Signal)
+		}
+	}
+
+	for _, line := range []string{"[1/3] exited with code 137", "[2/3] exited with code 130", "--- [3/3] sleep 30: interrupted (killed by signal 9)"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected the line [%s] in the output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestLocalExitCode(t *testing.T) {
+	commands := func(exitCodes ...int) []*Command {
+		var cmds []*Command
+		for _, exitCode := range exitCodes {
+			cmds = append(cmds, &Command{ExitCode: exitCode})
+		}
+		return cmds
+	}
+
+	tests := []struct {
+		task     Task
+		expected int
+	}{
+		{Task{State: TaskFinished, Commands: commands(0, 0)}, 0},
+		{Task{State: TaskFinished, Commands: commands(0, 2, 137)}, 2},
+		{Task{State: TaskFailed, Commands: commands(0)}, LocalFailedExitCode},
+		{Task{State: TaskTimedOut}, LocalTimedOutExitCode},
+		{Task{State: TaskCancelled}, LocalCancelledExitCode},
+	}
+
+	for _, test := range tests {
+		if exitCode := LocalExitCode(&test.task); exitCode != test.expected {
+			t.Errorf("Expected the exit code %d for %+v, got %d", test.expected, test.task, exitCode)
+		}
+	}
+}
+
+//A server that always has tasks to give. Each GET gets a new signed task, while the
+//reports wait until release is closed, so that the tasks keep their slots until then.
+type taskServer struct {
+	release chan struct{}
+	//The command of every task
+	command string
+	//It is called on each GET, before the task is given
+	onGet func()
+	mutex sync.Mutex
+	gets  int
+	//The states of the tasks in their reports, by task id
+	states map[uint][]TaskState
+}
+
+func newTaskServer() *taskServer {
+	return &taskServer{release: make(chan struct{}), command: "true", states: make(map[uint][]TaskState)}
+}
+
+func (s *taskServer) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		if s.onGet != nil {
+			s.onGet()
+		}
+		s.mutex.Lock()
+		s.gets++
+		body := []byte(fmt.Sprintf(`{"ID":%d,"Commands":[{"RawCommand":%q}]}`, s.gets, s.command))
+		s.mutex.Unlock()
+
+		header := http.Header{}
+		utils.SignResponse(header, 200, body, req, ServerKeyName)
+		return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}
+
+	select {
+	case <-s.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	var report Task
+	json.NewDecoder(req.Body).Decode(&report)
+	s.mutex.Lock()
+	s.states[report.ID] = append(s.states[report.ID], report.State)
+	s.mutex.Unlock()
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte{}))}, nil
+}
+
+//It returns the states of the task in its reports.
+func (s *taskServer) States(id uint) []TaskState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]TaskState(nil), s.states[id]...)
+}
+
+func (s *taskServer) Gets() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.gets
+}
+
+//It waits up to a second for cond to hold.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+//It sets up a worker with two slots, whose tasks are given by a new taskServer.
+func setupScheduler(t *testing.T, runner string) (*Scheduler, *taskServer, func()) {
+	previousKeys, previousClient := utils.Keys, utils.Client
+	worker := &Worker{Base: Base{ID: uuid.NewV4()}, Vcpu: 2, Ram: 2 * MinRamPerSlot, QueueID: 932, Token: "test-token", Runner: runner}
+	fakeKeys(worker.ID.String())
+	server := newTaskServer()
+	utils.Client = server
+
+	return NewScheduler(worker, "http://test-server:8000/v1"), server, func() {
+		utils.Keys, utils.Client = previousKeys, previousClient
+	}
+}
+
+func TestScheduler_LimitsTasksInFlight(t *testing.T) {
+	//setup
+	scheduler, server, teardown := setupScheduler(t, RunnerFake)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
+	//exercise
+	go func() {
+		scheduler.Start(ctx)
+		close(stopped)
+	}()
+
+	//verify
+	slots := scheduler.worker.Slots()
+	if !eventually(func() bool { return server.Gets() == slots }) {
+		t.Fatalf("Expected %d tasks to be got, got %d", slots, server.Gets())
+	}
+
+	//every slot is busy until the reports are answered, so no task must be asked for
+	time.Sleep(100 * time.Millisecond)
+	if gets := server.Gets(); gets != slots {
+		t.Errorf("The server has been polled while all the slots were busy: %d tasks got with %d slots", gets, slots)
+	}
+
+	close(server.release)
+	if !eventually(func() bool { return server.Gets() > slots }) {
+		t.Error("No task has been asked for after the slots have been released")
+	}
+
+	cancel()
+	<-stopped
+	scheduler.Drain(time.Second)
+}
+
+func TestScheduler_DrainWaitsForTheRunningTasks(t *testing.T) {
+	//setup
+	scheduler, server, teardown := setupScheduler(t, RunnerFake)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Start(ctx)
+		close(stopped)
+	}()
+	if !eventually(func() bool { return server.Gets() == 2 }) {
+		t.Fatalf("Expected 2 tasks to be got, got %d", server.Gets())
+	}
+
+	//exercise
+	cancel()
+	<-stopped
+	drained := make(chan struct{})
+	go func() {
+		scheduler.Drain(time.Minute)
+		close(drained)
+	}()
+
+	//verify
+	select {
+	case <-drained:
+		t.Fatal("The scheduler has been drained while its tasks were running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(server.release)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The scheduler has not been drained after its tasks were over")
+	}
+
+	for id := uint(1); id <= 2; id++ {
+		if states := server.States(id); len(states) == 0 || states[len(states)-1] != TaskFinished {
+			t.Errorf("Expected the task [%d] to finish, got the reports %v", id, states)
+		}
+	}
+}
+
+func TestScheduler_DrainCancelsTheTasksAfterTheGracePeriod(t *testing.T) {
+	//setup
+	defer setupBinPath(t)()
+	scheduler, server, teardown := setupScheduler(t, RunnerProcess)
+	defer teardown()
+	server.command = "sleep 30"
+	close(server.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Start(ctx)
+		close(stopped)
+	}()
+	if !eventually(func() bool { return server.Gets() == 2 }) {
+		t.Fatalf("Expected 2 tasks to be got, got %d", server.Gets())
+	}
+
+	//exercise
+	cancel()
+	<-stopped
+	start := time.Now()
+	scheduler.Drain(100 * time.Millisecond)
+
+	//verify
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("The tasks have not been cancelled after the grace period: drained in %s", elapsed)
+	}
+
+	for id := uint(1); id <= 2; id++ {
+		if states := server.States(id); len(states) == 0 || states[len(states)-1] != TaskCancelled {
+			t.Errorf("Expected the task [%d] to be cancelled, got the reports %v", id, states)
+		}
+	}
+}
+
+func TestScheduler_DoesNotStartATaskGotDuringTheShutdown(t *testing.T) {
+	//setup
+	scheduler, server, teardown := setupScheduler(t, RunnerFake)
+	defer teardown()
+	close(server.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	//the worker starts shutting down while the first task is on its way
+	server.onGet = cancel
+
+	//exercise
+	scheduler.Start(ctx)
+	scheduler.Drain(time.Second)
+
+	//verify
+	if gets := server.Gets(); gets != 1 {
+		t.Errorf("Expected a single task to be got, got %d", gets)
+	}
+
+	if states := server.States(1); !reflect.DeepEqual(states, []TaskState{TaskCancelled}) {
+		t.Errorf("Expected the task to be reported as cancelled without running, got the reports %v", states)
+	}
+}